@@ -1,77 +1,1034 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+/**
+所有的 stage 都接收一个 context.Context：
+一旦 ctx 被取消，stage 不再往下游发送数据，并且关闭自己的输出 Channel，
+这样即使消费者提前 break，上游的 Go Routine 也都能退出，不会泄漏。
+*/
+
 /*********************************************** Channel 转发函数 */
 
-func echo(nums []int) <-chan int {
+func echo(ctx context.Context, nums []int) <-chan int {
 	out := make(chan int)
 	go func() {
+		defer close(out)
 		for _, n := range nums {
-			out <- n
+			select {
+			case out <- n:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(out)
 	}()
 	return out
 }
 
 /*********************************************** 平方函数 */
 
-func sq(in <-chan int) <-chan int {
+func sq(ctx context.Context, in <-chan int) <-chan int {
 	out := make(chan int)
 	go func() {
+		defer close(out)
 		for n := range in {
-			out <- n * n
+			select {
+			case out <- n * n:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(out)
 	}()
 	return out
 }
 
 /*********************************************** 过滤奇数函数 */
 
-func odd(in <-chan int) <-chan int {
+func odd(ctx context.Context, in <-chan int) <-chan int {
 	out := make(chan int)
 	go func() {
+		defer close(out)
 		for n := range in {
-			if n%2 != 0 {
-				out <- n
+			if n%2 == 0 {
+				continue
+			}
+			select {
+			case out <- n:
+			case <-ctx.Done():
+				return
 			}
 		}
-		close(out)
 	}()
 	return out
 }
 
 /*********************************************** 求和函数 */
 
-func sum(in <-chan int) <-chan int {
+func sum(ctx context.Context, in <-chan int) <-chan int {
 	out := make(chan int)
 	go func() {
+		defer close(out)
 		var sum = 0
 		for n := range in {
 			sum += n
 		}
-		out <- sum
-		close(out)
+		// 上游因为 ctx 取消而提前关闭时，sum 只是部分结果，不再发送
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case out <- sum:
+		case <-ctx.Done():
+		}
+	}()
+	return out
+}
+
+/*********************************************** 泛型 Pipeline */
+/**
+Stage[In, Out] 把一个 In 类型的 Channel 变换成一个 Out 类型的 Channel。
+Then() 把两个 Stage 串起来，前一个 Stage 的 Out 必须就是后一个 Stage 的 In，这个在编译期就检查好了。
+因为 Go 的方法不能再带类型参数，所以没办法写成 a.Then(b).Then(c) 的链式调用，只能用函数嵌套：Then(Then(a, b), c)。
+*/
+
+type Stage[In, Out any] func(context.Context, <-chan In) <-chan Out
+
+type SourceFunc[T any] func(context.Context, []T) <-chan T
+
+// Source 是泛型版的 echo，把一个任意类型的 Slice 发送到 Channel 里
+func Source[T any](ctx context.Context, items []T) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for _, item := range items {
+			select {
+			case out <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 	return out
 }
 
+func Map[In, Out any](fn func(In) Out) Stage[In, Out] {
+	return func(ctx context.Context, in <-chan In) <-chan Out {
+		out := make(chan Out)
+		go func() {
+			defer close(out)
+			for item := range in {
+				select {
+				case out <- fn(item):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+}
+
+func Filter[T any](fn func(T) bool) Stage[T, T] {
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		go func() {
+			defer close(out)
+			for item := range in {
+				if !fn(item) {
+					continue
+				}
+				select {
+				case out <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+}
+
+func Then[A, B, C any](first Stage[A, B], next Stage[B, C]) Stage[A, C] {
+	return func(ctx context.Context, in <-chan A) <-chan C {
+		return next(ctx, first(ctx, in))
+	}
+}
+
+// Chain 把多个输入输出类型相同的 Stage 串成一个
+func Chain[T any](stages ...Stage[T, T]) Stage[T, T] {
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		for _, stage := range stages {
+			in = stage(ctx, in)
+		}
+		return in
+	}
+}
+
+func Run[In, Out any](ctx context.Context, items []In, source SourceFunc[In], stage Stage[In, Out]) <-chan Out {
+	return stage(ctx, source(ctx, items))
+}
+
+type Employee struct {
+	Name     string
+	Age      int
+	Vacation int
+	Salary   int
+}
+
+type Point struct {
+	X, Y int
+}
+
 /*********************************************** 代理函数 */
+/**
+EchoFunc 和 PipeFunc 只是 int 版本的 SourceFunc 和 Stage，原来的 echo、sq、odd、sum 都可以直接当成 Stage 来用。
+PipeFunc 自己在内部起 Go Routine，里面的 panic 从外面是 recover 不到的，所以 supervise() 没法直接包装一个 PipeFunc，
+需要崩溃隔离的 stage 要写成 StageBody（逐个元素处理的可以用 mapBody），见后面的崩溃隔离部分。
+*/
+
+type EchoFunc = SourceFunc[int]
+type PipeFunc = Stage[int, int]
+
+func pipeline(ctx context.Context, nums []int, echo EchoFunc, pipeFns ...PipeFunc) <-chan int {
+	return Run(ctx, nums, echo, Chain(pipeFns...))
+}
+
+/*********************************************** 错误处理 */
+/**
+原来的 stage 遇到坏数据只能默默丢掉，TryStage 处理每个元素时都可以返回一个 error，出错之后怎么办由 ErrPolicy 决定：
+1. FailFast：出现第一个错误就 cancel 整个 Pipeline，只记录这一个错误；
+2. SkipErrors：跳过出错的元素，把所有错误都收集起来；
+3. DeadLetter：把出错的元素连同错误一起发到死信 Channel 里，由调用者自己处理。
+*/
+
+type ErrPolicy int
+
+const (
+	FailFast ErrPolicy = iota
+	SkipErrors
+	DeadLetter
+)
+
+type StageError struct {
+	Stage string
+	Item  int
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %s: item %d: %v", e.Stage, e.Item, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+type TryFunc func(int) (int, error)
+
+type TryStage struct {
+	Name string
+	Fn   TryFunc
+}
+
+// PipelineResult 中 Out 被读完（关闭）之后，Errors() 才是完整的；
+// DeadLetter 策略下，调用者需要和 Out 同时读取 DeadLetter，否则出错的 stage 会阻塞在发送死信上。
+type PipelineResult struct {
+	Out        <-chan int
+	DeadLetter <-chan *StageError
+
+	mu   sync.Mutex
+	errs []error
+}
+
+func (r *PipelineResult) Errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]error(nil), r.errs...)
+}
+
+// Err 返回第一个错误，没有出错时返回 nil
+func (r *PipelineResult) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errs) == 0 {
+		return nil
+	}
+	return r.errs[0]
+}
+
+func (r *PipelineResult) addError(err error, onlyFirst bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if onlyFirst && len(r.errs) > 0 {
+		return false
+	}
+	r.errs = append(r.errs, err)
+	return true
+}
+
+func tryPipeline(ctx context.Context, nums []int, policy ErrPolicy, stages ...TryStage) *PipelineResult {
+	ctx, cancel := context.WithCancel(ctx)
+	dead := make(chan *StageError)
+	r := &PipelineResult{DeadLetter: dead}
+
+	// report 返回 false 表示当前 stage 应该停下来
+	report := func(se *StageError) bool {
+		switch policy {
+		case FailFast:
+			if r.addError(se, true) {
+				cancel()
+			}
+			return false
+		case DeadLetter:
+			select {
+			case dead <- se:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		default:
+			r.addError(se, false)
+			return true
+		}
+	}
+
+	var wg sync.WaitGroup
+	ch := echo(ctx, nums)
+	for _, stage := range stages {
+		out := make(chan int)
+		wg.Add(1)
+		go func(stage TryStage, in <-chan int, out chan<- int) {
+			defer wg.Done()
+			defer close(out)
+			for n := range in {
+				v, err := stage.Fn(n)
+				if err != nil {
+					if !report(&StageError{Stage: stage.Name, Item: n, Err: err}) {
+						return
+					}
+					continue
+				}
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(stage, ch, out)
+		ch = out
+	}
+	r.Out = ch
+
+	go func() {
+		wg.Wait()
+		close(dead)
+		cancel()
+	}()
+	return r
+}
+
+/*********************************************** 批处理和窗口 */
+/**
+sum 只能在整个流结束的时候给出一个总数，下面这几个 stage 可以把流切成一段一段的，再对每一段做聚合：
+1. Batch(n)：每 n 个元素打成一批；
+2. BatchTimeout(n, d)：凑够 n 个，或者这一批的第一个元素已经等了 d，就发出去；
+3. TumblingWindow(d)：按到达时间切成首尾相接、互不重叠的窗口，每个窗口长 d；
+4. SlidingWindow(size, slide)：每隔 slide 发出最近 size 时间内到达的元素，窗口之间会有重叠。
+输入关闭时，还没凑满的批次和窗口也会被发出去。窗口都是按处理时间（元素到达 stage 的时间）来算的。
+和 Batch 的 n 一样，不合法的窗口参数会被修正：size 至少是 minWindow，slide <= 0 时等于 size。
+*/
+
+const minWindow = time.Millisecond
+
+type Window[T any] struct {
+	Start, End time.Time
+	Items      []T
+}
+
+type WindowStats struct {
+	Start, End time.Time
+	Count      int
+	Sum        int
+	Min, Max   int
+}
+
+func Batch[T any](n int) Stage[T, []T] {
+	return BatchTimeout[T](n, 0)
+}
+
+// BatchTimeout 中 d <= 0 表示不超时
+func BatchTimeout[T any](n int, d time.Duration) Stage[T, []T] {
+	if n < 1 {
+		n = 1
+	}
+	return func(ctx context.Context, in <-chan T) <-chan []T {
+		out := make(chan []T)
+		go func() {
+			defer close(out)
+			var batch []T
+			var timer *time.Timer
+			var timeout <-chan time.Time
+			flush := func() bool {
+				if timer != nil {
+					timer.Stop()
+					timer, timeout = nil, nil
+				}
+				if len(batch) == 0 {
+					return true
+				}
+				select {
+				case out <- batch:
+					batch = nil
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+			for {
+				select {
+				case item, ok := <-in:
+					if !ok {
+						flush()
+						return
+					}
+					batch = append(batch, item)
+					if len(batch) == 1 && d > 0 {
+						timer = time.NewTimer(d)
+						timeout = timer.C
+					}
+					if len(batch) >= n && !flush() {
+						return
+					}
+				case <-timeout:
+					timer, timeout = nil, nil
+					if !flush() {
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+}
+
+func TumblingWindow[T any](d time.Duration) Stage[T, Window[T]] {
+	return SlidingWindow[T](d, d)
+}
+
+func SlidingWindow[T any](size, slide time.Duration) Stage[T, Window[T]] {
+	if size < minWindow {
+		size = minWindow
+	}
+	if slide <= 0 {
+		slide = size
+	}
+	type stamped struct {
+		at   time.Time
+		item T
+	}
+	return func(ctx context.Context, in <-chan T) <-chan Window[T] {
+		out := make(chan Window[T])
+		go func() {
+			defer close(out)
+			ticker := time.NewTicker(slide)
+			defer ticker.Stop()
+			var buf []stamped
+			emit := func(end time.Time) bool {
+				start := end.Add(-size)
+				// 丢掉已经滑出窗口的元素
+				i := 0
+				for i < len(buf) && buf[i].at.Before(start) {
+					i++
+				}
+				buf = buf[i:]
+				if len(buf) == 0 {
+					return true
+				}
+				w := Window[T]{Start: start, End: end, Items: make([]T, len(buf))}
+				for i, s := range buf {
+					w.Items[i] = s.item
+				}
+				select {
+				case out <- w:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+			for {
+				select {
+				case item, ok := <-in:
+					if !ok {
+						emit(time.Now())
+						return
+					}
+					buf = append(buf, stamped{time.Now(), item})
+				case now := <-ticker.C:
+					if !emit(now) {
+						return
+					}
+					// 滚动窗口不重叠，发出去之后就清空
+					if size <= slide {
+						buf = buf[:0]
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+}
+
+// Aggregate 计算一个窗口的 count/sum/min/max，配合 Map(Aggregate) 当成 stage 用
+func Aggregate(w Window[int]) WindowStats {
+	stats := WindowStats{Start: w.Start, End: w.End, Count: len(w.Items)}
+	for i, n := range w.Items {
+		stats.Sum += n
+		if i == 0 || n < stats.Min {
+			stats.Min = n
+		}
+		if i == 0 || n > stats.Max {
+			stats.Max = n
+		}
+	}
+	return stats
+}
+
+/*********************************************** 缓冲和背压 */
+/**
+每个 stage 都用的是无缓冲的 make(chan int)，一个慢的 stage 会把整条链都拖慢，
+背压虽然保证了内存不会涨，但也没法调节吞吐：
+1. Buffered(size, stage)：在 stage 的输出后面加一个 size 大小的缓冲，让它可以先跑在下游前面，size 小于 0 按 0 算；
+2. RateLimit(rate, burst)：令牌桶限流，平均每秒最多放行 rate 个元素，允许 burst 个突发，rate 不大于 0 时不限流；
+3. Lossy(size, mode, onDrop)：缓冲满了也不阻塞上游，按 DropOldest 丢掉最老的或者按 DropNewest 丢掉最新的，
+   适合丢一些数据也无所谓的监控数据流。
+*/
+
+func Buffer[T any](size int) Stage[T, T] {
+	if size < 0 {
+		size = 0
+	}
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T, size)
+		go func() {
+			defer close(out)
+			for item := range in {
+				select {
+				case out <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+}
+
+func Buffered[In, Out any](size int, stage Stage[In, Out]) Stage[In, Out] {
+	return Then(stage, Buffer[Out](size))
+}
+
+type tokenBucket struct {
+	rate   float64 // 每秒补充的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait 阻塞到拿到一个令牌，ctx 被取消时返回 false
+func (tb *tokenBucket) wait(ctx context.Context) bool {
+	for {
+		now := time.Now()
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+		if tb.tokens >= 1 {
+			tb.tokens--
+			return true
+		}
+		delay := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// RateLimit 的 rate 不大于 0（包括 NaN）时令牌永远补不上来，和 Batch、Lossy 一样把它当成能用的值：不限流，原样转发
+func RateLimit[T any](rate float64, burst int) Stage[T, T] {
+	if !(rate > 0) {
+		return Buffer[T](0)
+	}
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		go func() {
+			defer close(out)
+			tb := newTokenBucket(rate, burst)
+			for item := range in {
+				if !tb.wait(ctx) {
+					return
+				}
+				select {
+				case out <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+}
+
+type OverflowMode int
+
+const (
+	DropOldest OverflowMode = iota
+	DropNewest
+)
+
+// Lossy 中 onDrop 可以为 nil，不为 nil 时每丢一个元素调用一次
+func Lossy[T any](size int, mode OverflowMode, onDrop func(T)) Stage[T, T] {
+	if size < 1 {
+		size = 1
+	}
+	if onDrop == nil {
+		onDrop = func(T) {}
+	}
+	return func(ctx context.Context, in <-chan T) <-chan T {
+		out := make(chan T)
+		go func() {
+			defer close(out)
+			buf := make([]T, 0, size)
+			for in != nil || len(buf) > 0 {
+				// 缓冲为空时 send 是 nil，select 不会选中它
+				var send chan<- T
+				var head T
+				if len(buf) > 0 {
+					send, head = out, buf[0]
+				}
+				select {
+				case item, ok := <-in:
+					if !ok {
+						in = nil
+						continue
+					}
+					switch {
+					case len(buf) < size:
+						buf = append(buf, item)
+					case mode == DropOldest:
+						onDrop(buf[0])
+						buf = append(buf[1:], item)
+					default:
+						onDrop(item)
+					}
+				case send <- head:
+					buf = buf[1:]
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+}
+
+/*********************************************** Tee / Broadcast */
+/**
+merge() 是多对一，Broadcast() 反过来是一对多：in 里的每个元素都会发给 n 个订阅者。
+每个订阅者有自己 buffer 大小的缓冲，缓冲满了（订阅者太慢）怎么办由 SlowPolicy 决定：
+1. BlockSlow：等它，慢的订阅者会拖慢所有订阅者；
+2. DropSlow：这个元素对这个订阅者就丢掉了，其它订阅者不受影响；
+3. DisconnectSlow：直接关闭这个订阅者的 Channel，以后再也不发给它。
+不管哪种 SlowPolicy，ctx 被取消之后都会马上关闭所有订阅者的 Channel，不会等到 in 关闭；n 和 buffer 小于 0 按 0 算。
+Tee() 就是两个订阅者、不丢数据的 Broadcast()。
+*/
+
+type SlowPolicy int
+
+const (
+	BlockSlow SlowPolicy = iota
+	DropSlow
+	DisconnectSlow
+)
+
+func Broadcast[T any](ctx context.Context, in <-chan T, n, buffer int, policy SlowPolicy) []<-chan T {
+	if n < 0 {
+		n = 0
+	}
+	if buffer < 0 {
+		buffer = 0
+	}
+	subs := make([]chan T, n)
+	outs := make([]<-chan T, n)
+	for i := range subs {
+		subs[i] = make(chan T, buffer)
+		outs[i] = subs[i]
+	}
+	go func() {
+		defer func() {
+			for _, sub := range subs {
+				if sub != nil {
+					close(sub)
+				}
+			}
+		}()
+		for {
+			var item T
+			select {
+			case v, ok := <-in:
+				if !ok {
+					return
+				}
+				item = v
+			case <-ctx.Done():
+				return
+			}
+			for i, sub := range subs {
+				if sub == nil {
+					continue
+				}
+				if policy == BlockSlow {
+					select {
+					case sub <- item:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				select {
+				case sub <- item:
+				case <-ctx.Done():
+					return
+				default:
+					if policy == DisconnectSlow {
+						close(sub)
+						subs[i] = nil
+					}
+				}
+			}
+		}
+	}()
+	return outs
+}
+
+func Tee[T any](ctx context.Context, in <-chan T) (<-chan T, <-chan T) {
+	outs := Broadcast(ctx, in, 2, 0, BlockSlow)
+	return outs[0], outs[1]
+}
+
+/*********************************************** 崩溃隔离 */
+/**
+stage 的 Go Routine 里一旦 panic，整个进程就挂了。PipeFunc 自己在内部起 Go Routine，外面是没办法 recover 的，
+所以需要隔离的 stage 要写成 StageBody：只负责从 in 读、往 out 写，Go Routine 和关闭 out 都交给 supervise() 来做。
+supervise() 会 recover 住 panic，转成带调用栈的 PanicError 交给 onError，
+然后按 RestartPolicy 在同样的 in/out 上重启 StageBody，每次重启前的等待时间翻倍，直到 MaxRestarts 次。
+放弃重启之后，out 会被关闭，in 里剩下的元素会被读完丢掉，这样上游和 merge() 都不会卡住。
+正在处理的那个元素会随着 panic 一起丢掉。
+*/
+
+type StageBody func(ctx context.Context, in <-chan int, out chan<- int)
+
+type PanicError struct {
+	Stage string
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("stage %s panic: %v\n%s", e.Stage, e.Value, e.Stack)
+}
+
+type RestartPolicy struct {
+	MaxRestarts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// mapBody 把一个逐个元素处理的函数变成 StageBody
+func mapBody(fn func(int) int) StageBody {
+	return func(ctx context.Context, in <-chan int, out chan<- int) {
+		for n := range in {
+			select {
+			case out <- fn(n):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func runProtected(ctx context.Context, name string, body StageBody, in <-chan int, out chan<- int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Stage: name, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	body(ctx, in, out)
+	return nil
+}
+
+// supervise 中 onError 为 nil 时用 log 打印错误
+func supervise(name string, body StageBody, policy RestartPolicy, onError func(error)) PipeFunc {
+	if onError == nil {
+		onError = func(err error) { log.Println(err) }
+	}
+	return func(ctx context.Context, in <-chan int) <-chan int {
+		out := make(chan int)
+		go func() {
+			defer close(out)
+			backoff := policy.Backoff
+			for restarts := 0; ; restarts++ {
+				err := runProtected(ctx, name, body, in, out)
+				if err == nil {
+					return
+				}
+				onError(err)
+				if restarts >= policy.MaxRestarts {
+					onError(fmt.Errorf("stage %s: giving up after %d restarts", name, restarts))
+					for range in {
+					}
+					return
+				}
+				timer := time.NewTimer(backoff)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+				backoff *= 2
+				if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+					backoff = policy.MaxBackoff
+				}
+			}
+		}()
+		return out
+	}
+}
+
+/*********************************************** 监控指标 */
+/**
+Instrument() 在一个 stage 的前后各插入一个转发的 Go Routine，用来统计：
+1. In / Out：进入和离开这个 stage 的元素个数；
+2. Busy：等这个 stage 产出下一个元素的时间，Busy / Out 大致就是每个元素的处理时间；
+   Busy 里也包含了 stage 自己在等上游的时间，这部分单独记在 Starved 里，两者相减才是 stage 真正在干活的时间；
+3. Blocked：往下游发送时被阻塞的时间，这个值大说明瓶颈在下游；
+4. QueueLen / QueueCap：stage 输出 Channel 里排队的元素个数和容量，配合 Buffered() 使用才有意义。
+Pipeline 运行的过程中随时可以用 Snapshot() 拿到一份快照，Metrics 本身也是一个 http.Handler，输出 Prometheus 的文本格式。
+同一个名字只有一组计数：Instrument 返回的 stage 被调用多次（比如放在 FanOut 里起了好几份）时，所有副本累加到同一组计数上，
+QueueLen / QueueCap 是所有还在运行的副本加起来的值。
+*/
+
+type StageStats struct {
+	Name     string
+	In, Out  int64
+	Busy     time.Duration
+	Starved  time.Duration
+	Blocked  time.Duration
+	QueueLen int
+	QueueCap int
+}
+
+// PerItem 返回平均每个输出元素花在这个 stage 上的时间（不含等上游的时间）
+func (st StageStats) PerItem() time.Duration {
+	if st.Out == 0 || st.Busy < st.Starved {
+		return 0
+	}
+	return (st.Busy - st.Starved) / time.Duration(st.Out)
+}
+
+type stageCounters struct {
+	name                            string
+	in, out, busy, starved, blocked int64 // 使用 atomic 读写
+	queueMu                         sync.Mutex
+	queues                          map[int]func() (int, int) // 每个运行中的副本一个
+	nextQueue                       int
+}
+
+// addQueue 登记一个副本的输出 Channel，返回的函数在副本结束时调用
+func (c *stageCounters) addQueue(queue func() (int, int)) func() {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	id := c.nextQueue
+	c.nextQueue++
+	c.queues[id] = queue
+	return func() {
+		c.queueMu.Lock()
+		defer c.queueMu.Unlock()
+		delete(c.queues, id)
+	}
+}
+
+func (c *stageCounters) queue() (length, capacity int) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	for _, queue := range c.queues {
+		l, c := queue()
+		length += l
+		capacity += c
+	}
+	return length, capacity
+}
+
+type Metrics struct {
+	mu     sync.Mutex
+	stages []*stageCounters
+}
+
+// counters 返回 name 对应的计数，第一次用到这个名字时登记一组新的
+func (m *Metrics) counters(name string) *stageCounters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.stages {
+		if c.name == name {
+			return c
+		}
+	}
+	c := &stageCounters{name: name, queues: map[int]func() (int, int){}}
+	m.stages = append(m.stages, c)
+	return c
+}
 
-type EchoFunc func([]int) <-chan int
-type PipeFunc func(<-chan int) <-chan int
+func Instrument[In, Out any](m *Metrics, name string, stage Stage[In, Out]) Stage[In, Out] {
+	c := m.counters(name)
+	return func(ctx context.Context, in <-chan In) <-chan Out {
+		tapIn := make(chan In)
+		go func() {
+			defer close(tapIn)
+			for {
+				t := time.Now()
+				item, ok := <-in
+				atomic.AddInt64(&c.starved, int64(time.Since(t)))
+				if !ok {
+					return
+				}
+				atomic.AddInt64(&c.in, 1)
+				select {
+				case tapIn <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		stageOut := stage(ctx, tapIn)
+		removeQueue := c.addQueue(func() (int, int) { return len(stageOut), cap(stageOut) })
+
+		out := make(chan Out)
+		go func() {
+			defer close(out)
+			defer removeQueue()
+			for {
+				t := time.Now()
+				item, ok := <-stageOut
+				atomic.AddInt64(&c.busy, int64(time.Since(t)))
+				if !ok {
+					return
+				}
+				t = time.Now()
+				select {
+				case out <- item:
+					atomic.AddInt64(&c.blocked, int64(time.Since(t)))
+					atomic.AddInt64(&c.out, 1)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out
+	}
+}
+
+func (m *Metrics) Snapshot() []StageStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]StageStats, 0, len(m.stages))
+	for _, c := range m.stages {
+		st := StageStats{
+			Name:    c.name,
+			In:      atomic.LoadInt64(&c.in),
+			Out:     atomic.LoadInt64(&c.out),
+			Busy:    time.Duration(atomic.LoadInt64(&c.busy)),
+			Starved: time.Duration(atomic.LoadInt64(&c.starved)),
+			Blocked: time.Duration(atomic.LoadInt64(&c.blocked)),
+		}
+		st.QueueLen, st.QueueCap = c.queue()
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// labelEscaper 按 Prometheus 文本格式转义 label 的值，只需要转义反斜杠、双引号和换行，其它字符原样输出
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	stats := m.Snapshot()
+	metrics := []struct {
+		name, help, kind string
+		value            func(StageStats) float64
+	}{
+		{"pipeline_stage_items_in_total", "Items received by the stage.", "counter", func(st StageStats) float64 { return float64(st.In) }},
+		{"pipeline_stage_items_out_total", "Items emitted by the stage.", "counter", func(st StageStats) float64 { return float64(st.Out) }},
+		{"pipeline_stage_busy_seconds_total", "Time spent waiting for the stage to produce an item.", "counter", func(st StageStats) float64 { return st.Busy.Seconds() }},
+		{"pipeline_stage_starved_seconds_total", "Time spent waiting for upstream items.", "counter", func(st StageStats) float64 { return st.Starved.Seconds() }},
+		{"pipeline_stage_blocked_seconds_total", "Time spent blocked sending downstream.", "counter", func(st StageStats) float64 { return st.Blocked.Seconds() }},
+		{"pipeline_stage_queue_length", "Items queued in the stage output channel.", "gauge", func(st StageStats) float64 { return float64(st.QueueLen) }},
+		{"pipeline_stage_queue_capacity", "Capacity of the stage output channel.", "gauge", func(st StageStats) float64 { return float64(st.QueueCap) }},
+	}
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, st := range stats {
+			if _, err := fmt.Fprintf(w, "%s{stage=\"%s\"} %g\n", metric.name, labelEscaper.Replace(st.Name), metric.value(st)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-func pipeline(nums []int, echo EchoFunc, pipeFns ...PipeFunc) <-chan int {
-	ch := echo(nums)
-	for i := range pipeFns {
-		ch = pipeFns[i](ch)
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := m.WritePrometheus(w); err != nil {
+		log.Println("write metrics:", err)
 	}
-	return ch
 }
 
 /*********************************************** Fan in/Out */
@@ -87,40 +1044,60 @@ func makeRange(min, max int) []int {
 	return a
 }
 
+// is_prime 用试除法判断素数，只需要试到 sqrt(value)，并且跳过所有偶数
 func is_prime(value int) bool {
-	//for i := 2; i <= int(math.Floor(float64(value)/2)); i++ {
-	//	if value%i == 0 {
-	//		return false
-	//	}
-	//}
-	//return value > 1
-	return value%2 == 0
+	if value < 2 {
+		return false
+	}
+	if value%2 == 0 {
+		return value == 2
+	}
+	for i := 3; i*i <= value; i += 2 {
+		if value%i == 0 {
+			return false
+		}
+	}
+	return true
 }
 
-func prime(in <-chan int) <-chan int {
+func prime(ctx context.Context, in <-chan int) <-chan int {
 	out := make(chan int)
 	go func() {
+		defer close(out)
 		for n := range in {
-			if is_prime(n) {
-				out <- n
+			if !is_prime(n) {
+				continue
+			}
+			select {
+			case out <- n:
+			case <-ctx.Done():
+				return
 			}
 		}
-		close(out)
 	}()
 	return out
 }
 
-func merge(cs []<-chan int) <-chan int {
-	var wg sync.WaitGroup
-	out := make(chan int)
+func merge(ctx context.Context, cs []<-chan int) <-chan int {
 	println("cs ", len(cs))
+	return Merge(ctx, cs)
+}
+
+// Merge 是泛型版的 merge，把多个 Channel 合并成一个，顺序取决于 Go Routine 的调度
+func Merge[T any](ctx context.Context, cs []<-chan T) <-chan T {
+	var wg sync.WaitGroup
+	out := make(chan T)
 	wg.Add(len(cs))
 	for _, c := range cs {
-		go func(c <-chan int) {
-			for n := range c {
-				out <- n
+		go func(c <-chan T) {
+			defer wg.Done()
+			for item := range c {
+				select {
+				case out <- item:
+				case <-ctx.Done():
+					return
+				}
 			}
-			wg.Done()
 		}(c)
 	}
 
@@ -131,40 +1108,890 @@ func merge(cs []<-chan int) <-chan int {
 	return out
 }
 
-func main() {
-	//var nums = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
-	//for n := range sum(sq(odd(echo(nums)))) {
+/*********************************************** Worker Pool */
+/**
+FanOut 把同一个 stage 起 workers 份，一起消费同一个 in，最后自动 merge 成一个输出。
+ordered 为 false 时，每个 worker 上跑的是一整条 stage，输出顺序取决于调度；
+ordered 为 true 时，每个元素都带上序号，stage 对每个元素单独执行一次，最后用 orderedMerge 按序号重新排好，
+所以像 sum 这样有状态的 stage 在有序模式下只能看到单个元素。
+*/
+
+func FanOut(ctx context.Context, in <-chan int, workers int, stage PipeFunc, ordered bool) <-chan int {
+	if workers < 1 {
+		workers = 1
+	}
+	if !ordered {
+		cs := make([]<-chan int, workers)
+		for i := range cs {
+			cs[i] = stage(ctx, in)
+		}
+		return Merge(ctx, cs)
+	}
+
+	window := newReorderWindow(workers * 2)
+	tagged := tag(ctx, in, window)
+	cs := make([]<-chan seqItem, workers)
+	for i := range cs {
+		cs[i] = applyEach(ctx, tagged, stage)
+	}
+	return orderedMerge(ctx, cs, window)
+}
+
+// applyEach 对每个带序号的元素单独跑一次 stage，被过滤掉的元素也会输出一个空的 seqItem 占住序号
+func applyEach(ctx context.Context, in <-chan seqItem, stage PipeFunc) <-chan seqItem {
+	out := make(chan seqItem)
+	go func() {
+		defer close(out)
+		for item := range in {
+			var vals []int
+			for v := range pipeline(ctx, item.Vals, echo, stage) {
+				vals = append(vals, v)
+			}
+			select {
+			case out <- seqItem{Seq: item.Seq, Vals: vals}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+/*********************************************** 有序 merge */
+/**
+merge() 的输出顺序取决于 Go Routine 的调度，每次运行都可能不一样。
+orderedMerge() 要求每个元素在进入 Pipeline 之前就用 tag() 打上输入的序号，
+合并的时候把先到的元素放到重排缓冲区里，等前面的序号都到齐了再按顺序输出。
+
+重排缓冲区是有界的：tag() 每发出一个元素要先从 reorderWindow 拿一个名额，orderedMerge() 每按顺序输出一个序号才还回一个名额，
+所以在途（还没按顺序输出）的元素最多只有 size 个，缓冲区不会因为某个慢 worker 而无限增长。
+注意每个打了序号的元素都必须有且只有一个 seqItem 到达 orderedMerge()，否则后面的序号会一直等下去。
+*/
+
+type seqItem struct {
+	Seq  int
+	Vals []int
+}
+
+type reorderWindow chan struct{}
+
+func newReorderWindow(size int) reorderWindow {
+	if size < 1 {
+		size = 1
+	}
+	return make(reorderWindow, size)
+}
+
+// tag 给每个元素按输入顺序编号
+func tag(ctx context.Context, in <-chan int, window reorderWindow) <-chan seqItem {
+	out := make(chan seqItem)
+	go func() {
+		defer close(out)
+		seq := 0
+		for n := range in {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case out <- seqItem{Seq: seq, Vals: []int{n}}:
+				seq++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func orderedMerge(ctx context.Context, cs []<-chan seqItem, window reorderWindow) <-chan int {
+	in := Merge(ctx, cs)
+	out := make(chan int)
+	go func() {
+		defer close(out)
+		pending := make(map[int][]int, cap(window))
+		next := 0
+		for item := range in {
+			pending[item.Seq] = item.Vals
+			for {
+				vals, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+				for _, v := range vals {
+					select {
+					case out <- v:
+					case <-ctx.Done():
+						return
+					}
+				}
+				<-window
+			}
+		}
+	}()
+	return out
+}
+
+/*********************************************** 配置文件 */
+/**
+不用重新编译，用一个 YAML 或 JSON 文件就能描述一条 pipeline：
+1. source：makeRange(min, max) 的范围；
+2. stages：按顺序执行的 stage 名字，名字通过 stageRegistry 找到对应的 PipeFunc；
+3. fan_out：大于 1 时，stages 这一整条链会用 FanOut 起 fan_out 份；
+4. merge_stages：fan out 合并之后再执行的 stage，比如每个 worker 各自 sum 之后，还要再 sum 一次；
+5. sink：输出到哪里，stdout（默认）或者一个文件路径，每行一个数。
+文件的格式按扩展名来判断，.yaml/.yml 是 YAML，其它都按 JSON 解析。
+运行：go run case_channel.go -config case_channel_pipeline.yaml
+*/
+
+type PipelineConfig struct {
+	Source struct {
+		Min int `json:"min" yaml:"min"`
+		Max int `json:"max" yaml:"max"`
+	} `json:"source" yaml:"source"`
+	Stages      []string `json:"stages" yaml:"stages"`
+	FanOut      int      `json:"fan_out" yaml:"fan_out"`
+	MergeStages []string `json:"merge_stages" yaml:"merge_stages"`
+	Sink        string   `json:"sink" yaml:"sink"`
+}
+
+var stageRegistry = map[string]PipeFunc{
+	"odd":   odd,
+	"sq":    sq,
+	"prime": prime,
+	"sum":   sum,
+}
+
+func loadPipelineConfig(path string) (*PipelineConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf PipelineConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &conf)
+	default:
+		err = json.Unmarshal(data, &conf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if conf.Source.Max < conf.Source.Min {
+		return nil, fmt.Errorf("%s: source max %d is less than min %d", path, conf.Source.Max, conf.Source.Min)
+	}
+	// 写错的 stage 名字在加载的时候就报错，不要等跑到一半
+	for _, names := range [][]string{conf.Stages, conf.MergeStages} {
+		if _, err := lookupStages(names); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &conf, nil
+}
+
+func lookupStages(names []string) ([]PipeFunc, error) {
+	fns := make([]PipeFunc, 0, len(names))
+	for _, name := range names {
+		fn, ok := stageRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q", name)
+		}
+		fns = append(fns, fn)
+	}
+	return fns, nil
+}
+
+func runPipelineConfig(ctx context.Context, conf *PipelineConfig) error {
+	stages, err := lookupStages(conf.Stages)
+	if err != nil {
+		return err
+	}
+	mergeStages, err := lookupStages(conf.MergeStages)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if conf.Sink != "" && conf.Sink != "stdout" {
+		f, err := os.Create(conf.Sink)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	in := echo(ctx, makeRange(conf.Source.Min, conf.Source.Max))
+	var out <-chan int
+	if conf.FanOut > 1 {
+		out = FanOut(ctx, in, conf.FanOut, Chain(stages...), false)
+	} else {
+		out = Chain(stages...)(ctx, in)
+	}
+	for n := range Chain(mergeStages...)(ctx, out) {
+		if _, err := fmt.Fprintln(w, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*********************************************** Checkpoint */
+/**
+对几百万个元素跑 pipeline，中途挂掉的话只能从 makeRange 的第一个元素重新开始。
+resumablePipeline() 让 pipeline 可以从上一次的 checkpoint 接着跑：
+1. source 从 checkpoint 记下的 Offset 开始发送，每发送 every 个元素就插入一个 barrier；
+2. 每个 stage 都是一个 StatefulStage，按顺序一个一个地处理元素，收到 barrier 时把自己的状态 Snapshot() 进 barrier 再往下传，
+   所以 barrier 里每个 stage 的状态都正好对应 Offset 之前的那些元素，是一致的；
+3. barrier 到达最后时，把 Offset 和所有 stage 的状态一起写进 checkpoint 文件，先写临时文件再 rename，
+   所以文件要么是上一次的 checkpoint，要么是这一次的，不会是写了一半的；
+4. 重新运行时先用 Restore() 恢复每个 stage 的状态，再从 Offset 接着发送，全部跑完之后删除 checkpoint 文件。
+像 odd、sq 这样无状态的 PipeFunc 用 Stateless() 包装，sum 对应的是 SumStage。
+checkpoint 里还记着输入的个数和哈希值以及每个 stage 的名字，换了输入或者 stage 再运行会直接报错，而不是接着一个对不上的 checkpoint 跑。
+注意 checkpoint 之后、挂掉之前已经输出的元素，重新运行时会再输出一次；SumStage 只在最后输出，不受影响。
+*/
+
+// StatefulStage 逐个处理元素，Finish 在输入正常结束时调用，用来输出最后的结果
+type StatefulStage interface {
+	Process(ctx context.Context, n int) []int
+	Finish() []int
+	Snapshot() (json.RawMessage, error)
+	Restore(state json.RawMessage) error
+}
+
+type CheckpointStage struct {
+	Name  string
+	Stage StatefulStage
+}
+
+// Stateless 把无状态的 PipeFunc 包装成 StatefulStage，和有序 FanOut 的 applyEach 一样，每个元素单独跑一次
+func Stateless(fn PipeFunc) StatefulStage {
+	return statelessStage{fn}
+}
+
+type statelessStage struct {
+	fn PipeFunc
+}
+
+func (s statelessStage) Process(ctx context.Context, n int) []int {
+	var vals []int
+	for v := range pipeline(ctx, []int{n}, echo, s.fn) {
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+func (statelessStage) Finish() []int                       { return nil }
+func (statelessStage) Snapshot() (json.RawMessage, error)  { return json.RawMessage("null"), nil }
+func (statelessStage) Restore(state json.RawMessage) error { return nil }
+
+// SumStage 和 sum 一样，输入结束时输出所有元素的和，Total 就是它的状态
+type SumStage struct {
+	Total int `json:"total"`
+}
+
+func (s *SumStage) Process(ctx context.Context, n int) []int {
+	s.Total += n
+	return nil
+}
+
+func (s *SumStage) Finish() []int {
+	return []int{s.Total}
+}
+
+func (s *SumStage) Snapshot() (json.RawMessage, error) {
+	return json.Marshal(s)
+}
+
+func (s *SumStage) Restore(state json.RawMessage) error {
+	return json.Unmarshal(state, s)
+}
+
+// Fingerprint 标识 checkpoint 是哪份输入、哪条 pipeline 产生的
+type Fingerprint struct {
+	Items  int      `json:"items"`
+	Hash   uint64   `json:"hash"` // 所有输入的 FNV-1a
+	Stages []string `json:"stages"`
+}
+
+func fingerprint(nums []int, stages []CheckpointStage) Fingerprint {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, n := range nums {
+		binary.LittleEndian.PutUint64(buf[:], uint64(n))
+		h.Write(buf[:])
+	}
+	f := Fingerprint{Items: len(nums), Hash: h.Sum64()}
+	for _, st := range stages {
+		f.Stages = append(f.Stages, st.Name)
+	}
+	return f
+}
+
+func (f Fingerprint) String() string {
+	return fmt.Sprintf("%d items (hash %x) through %s", f.Items, f.Hash, strings.Join(f.Stages, " | "))
+}
+
+type Checkpoint struct {
+	Fingerprint Fingerprint                `json:"fingerprint"`
+	Offset      int                        `json:"offset"`
+	States      map[string]json.RawMessage `json:"states"`
+}
+
+// loadCheckpoint 在文件不存在时返回 nil
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("parse checkpoint %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+func saveCheckpoint(path string, cp *Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkpointEvent 是 resumablePipeline 里流动的元素，barrier 不为 nil 时它是一个 checkpoint 的分界线
+type checkpointEvent struct {
+	n       int
+	barrier *Checkpoint
+}
+
+// resumablePipeline 在开始之前检查并恢复 checkpoint，这一步出错直接返回 error；
+// 运行中的错误（包括 ctx 被取消）在 Out 被读完之后通过 Err() 拿到，这时 checkpoint 文件会留下来给下一次运行
+func resumablePipeline(ctx context.Context, nums []int, path string, every int, stages ...CheckpointStage) (*PipelineResult, error) {
+	if every < 1 {
+		every = 1
+	}
+	names := map[string]bool{}
+	for _, st := range stages {
+		if names[st.Name] {
+			return nil, fmt.Errorf("checkpoint: duplicate stage name %q", st.Name)
+		}
+		names[st.Name] = true
+	}
+	fp := fingerprint(nums, stages)
+	cp, err := loadCheckpoint(path)
+	if err != nil {
+		return nil, err
+	}
+	offset := 0
+	if cp != nil {
+		if cp.Fingerprint.String() != fp.String() {
+			return nil, fmt.Errorf("checkpoint %s was written for %v, not %v", path, cp.Fingerprint, fp)
+		}
+		if cp.Offset > len(nums) {
+			return nil, fmt.Errorf("checkpoint %s: offset %d is beyond %d items", path, cp.Offset, len(nums))
+		}
+		for _, st := range stages {
+			if err := st.Stage.Restore(cp.States[st.Name]); err != nil {
+				return nil, fmt.Errorf("checkpoint %s: restore stage %s: %w", path, st.Name, err)
+			}
+		}
+		offset = cp.Offset
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &PipelineResult{}
+	fail := func(err error) {
+		if r.addError(err, true) {
+			cancel()
+		}
+	}
+	send := func(out chan<- checkpointEvent, ev checkpointEvent) bool {
+		select {
+		case out <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	source := make(chan checkpointEvent)
+	go func() {
+		defer close(source)
+		for i := offset; i < len(nums); i++ {
+			if !send(source, checkpointEvent{n: nums[i]}) {
+				return
+			}
+			if (i+1-offset)%every == 0 && i+1 < len(nums) {
+				barrier := &Checkpoint{Fingerprint: fp, Offset: i + 1, States: map[string]json.RawMessage{}}
+				if !send(source, checkpointEvent{barrier: barrier}) {
+					return
+				}
+			}
+		}
+	}()
+
+	var ch <-chan checkpointEvent = source
+	for _, st := range stages {
+		out := make(chan checkpointEvent)
+		go func(st CheckpointStage, in <-chan checkpointEvent, out chan<- checkpointEvent) {
+			defer close(out)
+			for ev := range in {
+				if ev.barrier != nil {
+					state, err := st.Stage.Snapshot()
+					if err != nil {
+						fail(fmt.Errorf("checkpoint: snapshot stage %s: %w", st.Name, err))
+						return
+					}
+					ev.barrier.States[st.Name] = state
+					if !send(out, ev) {
+						return
+					}
+					continue
+				}
+				for _, v := range st.Stage.Process(ctx, ev.n) {
+					if !send(out, checkpointEvent{n: v}) {
+						return
+					}
+				}
+			}
+			// 输入是因为 ctx 被取消才关闭的，这时的状态只对应一部分输入，不能输出
+			if ctx.Err() != nil {
+				return
+			}
+			for _, v := range st.Stage.Finish() {
+				if !send(out, checkpointEvent{n: v}) {
+					return
+				}
+			}
+		}(st, ch, out)
+		ch = out
+	}
+
+	out := make(chan int)
+	r.Out = out
+	go func() {
+		defer close(out)
+		defer cancel()
+		for ev := range ch {
+			if ev.barrier != nil {
+				if err := saveCheckpoint(path, ev.barrier); err != nil {
+					fail(err)
+					return
+				}
+				continue
+			}
+			select {
+			case out <- ev.n:
+			case <-ctx.Done():
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			fail(err)
+			return
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fail(err)
+		}
+	}()
+	return r, nil
+}
+
+/*********************************************** 素数筛 */
+/**
+prime() 对每个数都做一次试除，数一多就很慢。sieve() 用分段的埃拉托斯特尼筛法直接生成 [min, max] 之间的素数：
+1. 先用普通的筛法求出 sqrt(max) 以内的素数，作为基础素数；
+2. 把 [min, max] 按 segment 大小切成很多段，每段用 tag() 打上序号，交给 workers 个 Go Routine 并发去筛；
+3. 每段筛出来的素数用 orderedMerge() 按段的顺序输出，所以结果是从小到大有序的，可以直接接给 sum() 这样的 stage。
+*/
+
+func sieve(ctx context.Context, min, max, segment, workers int) <-chan int {
+	if min < 2 {
+		min = 2
+	}
+	if segment < 1 {
+		segment = 1 << 16
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	// 小于 2 就没有素数，max 是负数时 math.Sqrt 还会得到 NaN
+	if max < 2 {
+		out := make(chan int)
+		close(out)
+		return out
+	}
+	base := smallPrimes(int(math.Sqrt(float64(max))))
+
+	var starts []int
+	for lo := min; lo <= max; lo += segment {
+		starts = append(starts, lo)
+	}
+	window := newReorderWindow(workers * 2)
+	tagged := tag(ctx, echo(ctx, starts), window)
+	cs := make([]<-chan seqItem, workers)
+	for i := range cs {
+		cs[i] = sieveSegments(ctx, tagged, base, segment, max)
+	}
+	return orderedMerge(ctx, cs, window)
+}
+
+// smallPrimes 用普通的筛法求出 n 以内的所有素数
+func smallPrimes(n int) []int {
+	composite := make([]bool, n+1)
+	var primes []int
+	for i := 2; i <= n; i++ {
+		if composite[i] {
+			continue
+		}
+		primes = append(primes, i)
+		for j := i * i; j <= n; j += i {
+			composite[j] = true
+		}
+	}
+	return primes
+}
+
+func sieveSegments(ctx context.Context, in <-chan seqItem, base []int, segment, max int) <-chan seqItem {
+	out := make(chan seqItem)
+	go func() {
+		defer close(out)
+		composite := make([]bool, segment)
+		for item := range in {
+			lo := item.Vals[0]
+			hi := lo + segment - 1
+			if hi > max {
+				hi = max
+			}
+			for i := range composite {
+				composite[i] = false
+			}
+			for _, p := range base {
+				if p*p > hi {
+					break
+				}
+				// 从段内第一个 p 的倍数开始划掉，但不能划掉 p 自己
+				start := (lo + p - 1) / p * p
+				if start < p*p {
+					start = p * p
+				}
+				for j := start; j <= hi; j += p {
+					composite[j-lo] = true
+				}
+			}
+			var primes []int
+			for n := lo; n <= hi; n++ {
+				if !composite[n-lo] {
+					primes = append(primes, n)
+				}
+			}
+			select {
+			case out <- seqItem{Seq: item.Seq, Vals: primes}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func main() {
+	workers := flag.Int("workers", 5, "number of fan-out workers")
+	metricsAddr := flag.String("metrics", "", "serve pipeline metrics on this address, e.g. :9090")
+	config := flag.String("config", "", "run the pipeline described in this YAML or JSON file and exit")
+	flag.Parse()
+
+	if *config != "" {
+		conf, err := loadPipelineConfig(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runPipelineConfig(context.Background(), conf); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//var nums = []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	//for n := range sum(ctx, sq(ctx, odd(ctx, echo(ctx, nums)))) {
 	//	fmt.Println(n)
 	//}
 	//
 	///**
 	//类似于我们执行了 Unix/Linux 命令： echo $nums | sq | sum
 	//*/
-	//for n := range pipeline(nums, echo, odd, sq, sum) {
+	//for n := range pipeline(ctx, nums, echo, odd, sq, sum) {
 	//	fmt.Println(n)
 	//}
 
 	/**
 	1. 首先，我们制造了从 1 到 10000 的数组；
 	2. 然后，把这堆数组全部 echo到一个 Channel 里—— in；
-	3. 此时，生成 5 个 Channel，接着都调用 sum(prime(in)) ，于是，每个 Sum 的 Go Routine 都会开始计算和；
+	3. 此时，用 FanOut 生成 workers 个（默认 5 个，可以用 -workers 参数修改）sum(prime(in)) ，于是，每个 Sum 的 Go Routine 都会开始计算和；
 	4. 最后，再把所有的结果再求和拼起来，得到最终的结果。
 	*/
 	nums := makeRange(1, 10)
 	for _, num := range nums {
 		println(num, is_prime(num))
 	}
-	in := echo(nums)
+	in := echo(ctx, nums)
 
-	var chans [5]<-chan int
-	for i := range chans {
-		ints := prime(in)
-		chans[i] = sum(ints)
-	}
-	for n := range sum(merge(chans[:])) {
+	for n := range sum(ctx, FanOut(ctx, in, *workers, Chain(prime, sum), false)) {
 		fmt.Println(n)
 	}
 
+	/**
+	有序模式下，输出的顺序和输入的顺序一致，多跑几次结果都一样，见 TestOrderedFanOutDeterministic
+	*/
+	var ordered []int
+	for n := range FanOut(ctx, echo(ctx, makeRange(1, 20)), *workers, Chain(odd, sq), true) {
+		ordered = append(ordered, n)
+	}
+	fmt.Println("ordered:", ordered)
+
+	/*********************************************** 泛型 Pipeline */
+	/**
+	Employee 先被过滤出年龄大于 30 的，再变成 Point，最后算出每个 Point 的距离，
+	每一步的类型都不一样，但都是在编译期检查的。
+	*/
+	employees := []Employee{
+		{"Hao", 44, 0, 8000},
+		{"Bob", 34, 10, 5000},
+		{"Alice", 23, 5, 9000},
+	}
+	older := Filter(func(e Employee) bool { return e.Age > 30 })
+	toPoint := Map(func(e Employee) Point { return Point{X: e.Age, Y: e.Salary / 1000} })
+	distance := Map(func(p Point) float64 { return math.Sqrt(float64(p.X*p.X + p.Y*p.Y)) })
+	for d := range Run(ctx, employees, Source[Employee], Then(Then(older, toPoint), distance)) {
+		fmt.Printf("distance %.2f\n", d)
+	}
+
+	/*********************************************** 错误处理 */
+	/**
+	half 遇到奇数就报错，SkipErrors 策略下偶数的一半照常输出，奇数的错误最后通过 Errors() 拿到。
+	*/
+	half := TryStage{"half", func(n int) (int, error) {
+		if n%2 != 0 {
+			return 0, fmt.Errorf("%d is odd", n)
+		}
+		return n / 2, nil
+	}}
+	result := tryPipeline(ctx, makeRange(1, 6), SkipErrors, half)
+	for n := range result.Out {
+		fmt.Println("half", n)
+	}
+	for _, err := range result.Errors() {
+		fmt.Println("skipped:", err)
+	}
+
+	result = tryPipeline(ctx, makeRange(1, 6), FailFast, half)
+	for n := range result.Out {
+		fmt.Println("half", n)
+	}
+	fmt.Println("fail fast:", result.Err())
+
+	result = tryPipeline(ctx, makeRange(1, 6), DeadLetter, half)
+	go func() {
+		for se := range result.DeadLetter {
+			fmt.Println("dead letter:", se.Item, se.Err)
+		}
+	}()
+	for n := range result.Out {
+		fmt.Println("half", n)
+	}
+
+	/*********************************************** 素数筛 */
+	/**
+	100 以内的素数，和试除法的结果一样，见 TestSieveMatchesTrialDivision；
+	两种方法的性能对比用 go test -bench . case_channel.go case_channel_test.go
+	*/
+	var sieved []int
+	for n := range sieve(ctx, 1, 100, 16, *workers) {
+		sieved = append(sieved, n)
+	}
+	fmt.Println("primes:", sieved)
+
+	/*********************************************** 批处理和窗口 */
+	for b := range Run(ctx, makeRange(1, 10), Source[int], Batch[int](4)) {
+		fmt.Println("batch", b)
+	}
+
+	/**
+	每 5ms 来一个数，按 50ms 的滚动窗口统计，得到的是一段一段的滚动指标，而不是最后的一个总数
+	*/
+	slow := Map(func(n int) int {
+		time.Sleep(5 * time.Millisecond)
+		return n
+	})
+	windowed := Then(Then(slow, TumblingWindow[int](50*time.Millisecond)), Map(Aggregate))
+	for w := range Run(ctx, makeRange(1, 40), Source[int], windowed) {
+		fmt.Printf("window count=%d sum=%d min=%d max=%d\n", w.Count, w.Sum, w.Min, w.Max)
+	}
+
+	/*********************************************** 缓冲和背压 */
+	/**
+	限流为每秒 200 个、突发 10 个，前 10 个立刻放行，后面的每 5ms 一个
+	*/
+	start := time.Now()
+	for range Run(ctx, makeRange(1, 30), Source[int], Buffered(8, RateLimit[int](200, 10))) {
+	}
+	fmt.Println("rate limited 30 items in", time.Since(start).Round(10*time.Millisecond))
+
+	/**
+	上游一下子发出 100 个数，下游每个要处理 1ms，缓冲只有 5 个，丢掉最老的，下游最后总能看到最新的数据
+	*/
+	dropped := 0
+	var latest []int
+	for n := range Run(ctx, makeRange(1, 100), Source[int], Lossy[int](5, DropOldest, func(int) { dropped++ })) {
+		time.Sleep(time.Millisecond)
+		latest = append(latest, n)
+	}
+	fmt.Println("lossy dropped", dropped, "tail", latest[len(latest)-5:])
+
+	/*********************************************** Tee / Broadcast */
+	/**
+	同一份 echo() 的输出，一份给 sum 求和，一份给审计日志，两边都能看到每一个元素
+	*/
+	toSum, toAudit := Tee(ctx, echo(ctx, makeRange(1, 5)))
+	audited := make(chan struct{})
+	go func() {
+		defer close(audited)
+		for n := range toAudit {
+			fmt.Println("audit", n)
+		}
+	}()
+	for n := range sum(ctx, toSum) {
+		fmt.Println("tee sum", n)
+	}
+	<-audited
+
+	/**
+	每 5ms 广播一个数，第二个订阅者一个都不读，缓冲满了之后就被断开，不会拖住第一个订阅者。
+	注意 DropSlow 和 DisconnectSlow 只看缓冲满没满，如果上游比所有订阅者都快，快的订阅者也一样会丢数据或被断开。
+	*/
+	subs := Broadcast(ctx, slow(ctx, echo(ctx, makeRange(1, 20))), 2, 4, DisconnectSlow)
+	received := 0
+	for range subs[0] {
+		received++
+	}
+	lagging := 0
+	for range subs[1] {
+		lagging++
+	}
+	fmt.Println("broadcast fast subscriber got", received, "slow subscriber got", lagging, "before disconnect")
+
+	/*********************************************** 监控指标 */
+	/**
+	slowSq 每个元素要 2ms，运行过程中打印的快照里 slowSq 的 Busy 最大，它就是瓶颈。
+	加上 -metrics :9090 参数的话，可以在 http://localhost:9090/metrics 看到 Prometheus 格式的指标。
+	*/
+	metrics := &Metrics{}
+	if *metricsAddr != "" {
+		http.Handle("/metrics", metrics)
+		go func() {
+			log.Println(http.ListenAndServe(*metricsAddr, nil))
+		}()
+	}
+	slowSq := Map(func(n int) int {
+		time.Sleep(2 * time.Millisecond)
+		return n * n
+	})
+	instrumented := Chain(
+		Instrument(metrics, "odd", PipeFunc(odd)),
+		Instrument(metrics, "slowSq", Buffered(4, slowSq)),
+		Instrument(metrics, "sum", PipeFunc(sum)),
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := range pipeline(ctx, makeRange(1, 100), echo, instrumented) {
+			fmt.Println("instrumented sum", n)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for _, st := range metrics.Snapshot() {
+		fmt.Printf("%-8s in=%d out=%d busy=%v per-item=%v blocked=%v queue=%d/%d\n",
+			st.Name, st.In, st.Out, st.Busy.Round(time.Millisecond), st.PerItem().Round(time.Microsecond),
+			st.Blocked.Round(time.Millisecond), st.QueueLen, st.QueueCap)
+	}
+	<-done
+	metrics.WritePrometheus(os.Stdout)
+
+	/*********************************************** Checkpoint */
+	/**
+	第一次运行 60ms 之后就被取消（模拟进程挂掉），第二次运行从 checkpoint 接着跑，结果和一次跑完是一样的；
+	换了输入的话 checkpoint 对不上，直接报错
+	*/
+	cpPath := filepath.Join(os.TempDir(), "case_channel.checkpoint")
+	os.Remove(cpPath)
+	cpStages := func() []CheckpointStage {
+		return []CheckpointStage{{"odd", Stateless(odd)}, {"slow", Stateless(slow)}, {"sq", Stateless(sq)}, {"sum", &SumStage{}}}
+	}
+	runResumable := func(ctx context.Context, nums []int) {
+		result, err := resumablePipeline(ctx, nums, cpPath, 10, cpStages()...)
+		if err != nil {
+			fmt.Println("resume:", err)
+			return
+		}
+		for n := range result.Out {
+			fmt.Println("resumable sum", n)
+		}
+		if err := result.Err(); err != nil {
+			// 第一个 barrier 之前就崩溃了的话，还没有 checkpoint 文件
+			if saved, _ := loadCheckpoint(cpPath); saved != nil {
+				fmt.Println("crashed:", err, "checkpoint at offset", saved.Offset, "states", saved.States)
+			} else {
+				fmt.Println("crashed:", err, "before the first checkpoint")
+			}
+		}
+	}
+	crashCtx, crash := context.WithTimeout(ctx, 60*time.Millisecond)
+	runResumable(crashCtx, makeRange(1, 200))
+	crash()
+	runResumable(ctx, makeRange(1, 300))
+	runResumable(ctx, makeRange(1, 200))
+
+	/*********************************************** 崩溃隔离 */
+	/**
+	fragile 遇到 13 的倍数就 panic，被 supervise() 接住之后重启，最多重启 3 次，
+	第 4 次 panic 之后放弃，剩下的元素被丢掉，merge() 照样能正常结束
+	*/
+	fragile := mapBody(func(n int) int {
+		if n%13 == 0 {
+			panic(fmt.Sprintf("unlucky %d", n))
+		}
+		return n
+	})
+	var panics int
+	onPanic := func(err error) {
+		var pe *PanicError
+		if errors.As(err, &pe) {
+			panics++
+			fmt.Println("recovered:", pe.Value)
+			return
+		}
+		fmt.Println(err)
+	}
+	guarded := supervise("fragile", fragile, RestartPolicy{MaxRestarts: 3, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}, onPanic)
+	survived := 0
+	for range merge(ctx, []<-chan int{guarded(ctx, echo(ctx, makeRange(1, 100)))}) {
+		survived++
+	}
+	fmt.Println("supervised stage emitted", survived, "items after", panics, "panics")
+
 	//var chans1 <-chan int
 	//chans1 = sum(prime(in))
 	//chanSum := sum(chans1)
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitNoLeak 等退出的 Go Routine 结束，最多等一秒，之后还比 before 多就是泄漏了
+func waitNoLeak(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutines leaked: %d before, %d after", before, after)
+	}
+}
+
+func TestPipelineEarlyBreakNoLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	for range pipeline(ctx, makeRange(1, 1000), echo, odd, sq) {
+		if count++; count == 3 {
+			break
+		}
+	}
+	cancel()
+	waitNoLeak(t, before)
+}
+
+func TestOrderedFanOutDeterministic(t *testing.T) {
+	var want []int
+	for _, n := range makeRange(1, 200) {
+		if n%2 != 0 {
+			want = append(want, n*n)
+		}
+	}
+	// odd 会过滤掉一半的元素，这些元素在 orderedMerge 里是空的 seqItem
+	for round := 0; round < 20; round++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		var got []int
+		for n := range FanOut(ctx, echo(ctx, makeRange(1, 200)), 5, Chain(odd, sq), true) {
+			got = append(got, n)
+		}
+		cancel()
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("round %d: got %v, want %v", round, got, want)
+		}
+	}
+}
+
+func TestOrderedFanOutCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	out := FanOut(ctx, echo(ctx, makeRange(1, 10000)), 5, Chain(odd, sq), true)
+	for i := 1; i <= 10; i++ {
+		if n := <-out; n != (2*i-1)*(2*i-1) {
+			t.Fatalf("item %d: got %d, want %d", i, n, (2*i-1)*(2*i-1))
+		}
+	}
+	cancel()
+
+	// 取消之后最多还能读到几个已经排好序的元素，然后输出就要关闭
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for range out {
+		}
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("output not closed after cancel")
+	}
+
+	waitNoLeak(t, before)
+}
+
+func TestSieveMatchesTrialDivision(t *testing.T) {
+	ctx := context.Background()
+	var want []int
+	for n := range pipeline(ctx, makeRange(1, 10000), echo, prime) {
+		want = append(want, n)
+	}
+	// 段的大小故意不整除范围，最后一段是不完整的
+	for _, min := range []int{1, 2, 97} {
+		var got []int
+		for n := range sieve(ctx, min, 10000, 333, 4) {
+			got = append(got, n)
+		}
+		var expect []int
+		for _, n := range want {
+			if n >= min {
+				expect = append(expect, n)
+			}
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("sieve(%d, 10000) = %v, want %v", min, got, expect)
+		}
+	}
+	for _, max := range []int{-5, 0, 1} {
+		if n := countInts(sieve(ctx, 1, max, 333, 4)); n != 0 {
+			t.Fatalf("sieve(1, %d) produced %d primes, want none", max, n)
+		}
+	}
+}
+
+const benchmarkMax = 10_000_000
+
+func countInts(ch <-chan int) int {
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
+
+func BenchmarkTrialDivision(b *testing.B) {
+	nums := makeRange(1, benchmarkMax)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		countInts(pipeline(context.Background(), nums, echo, prime))
+	}
+}
+
+func BenchmarkTrialDivisionFanOut(b *testing.B) {
+	nums := makeRange(1, benchmarkMax)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx := context.Background()
+		countInts(FanOut(ctx, echo(ctx, nums), runtime.GOMAXPROCS(0), prime, false))
+	}
+}
+
+func BenchmarkSegmentedSieve(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		countInts(sieve(context.Background(), 1, benchmarkMax, 1<<16, runtime.GOMAXPROCS(0)))
+	}
+}
+
+func TestWindowClampsInvalidDurations(t *testing.T) {
+	ctx := context.Background()
+	stages := map[string]Stage[int, Window[int]]{
+		"TumblingWindow(0)":      TumblingWindow[int](0),
+		"SlidingWindow(-1s, 0)":  SlidingWindow[int](-time.Second, 0),
+		"SlidingWindow(10ms, 0)": SlidingWindow[int](10*time.Millisecond, 0),
+	}
+	for name, stage := range stages {
+		n := 0
+		for w := range Run(ctx, makeRange(1, 10), Source[int], stage) {
+			n += len(w.Items)
+		}
+		if n != 10 {
+			t.Fatalf("%s: got %d items, want 10", name, n)
+		}
+	}
+}
+
+func TestInvalidBufferAndRateAreClamped(t *testing.T) {
+	ctx := context.Background()
+	stages := map[string]PipeFunc{
+		"Buffer(-1)":       Buffer[int](-1),
+		"Buffered(-1, sq)": Buffered(-1, PipeFunc(sq)),
+	}
+	for _, rate := range []float64{0, -1, math.NaN()} {
+		stages[fmt.Sprintf("RateLimit(%v, 1)", rate)] = RateLimit[int](rate, 1)
+	}
+	for name, stage := range stages {
+		// 不限流时 1000 个元素一下子就能全部通过
+		start := time.Now()
+		if n := countInts(stage(ctx, echo(ctx, makeRange(1, 1000)))); n != 1000 {
+			t.Fatalf("%s: got %d items, want 1000", name, n)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("%s: took %v", name, d)
+		}
+	}
+}
+
+func TestInstrumentSharesCountersAcrossFanOut(t *testing.T) {
+	ctx := context.Background()
+	m := &Metrics{}
+	for range FanOut(ctx, echo(ctx, makeRange(1, 100)), 4, Instrument(m, "sq", PipeFunc(sq)), false) {
+	}
+	stats := m.Snapshot()
+	if len(stats) != 1 || stats[0].In != 100 || stats[0].Out != 100 {
+		t.Fatalf("got %+v, want one stage with 100 in and 100 out", stats)
+	}
+
+	var buf strings.Builder
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(buf.String(), `pipeline_stage_items_in_total{stage="sq"}`); got != 1 {
+		t.Fatalf("got %d series for stage sq, want 1:\n%s", got, buf.String())
+	}
+}
+
+func TestWritePrometheusEscapesLabels(t *testing.T) {
+	m := &Metrics{}
+	m.counters("平方 \"sq\"\\\n")
+	var buf strings.Builder
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `pipeline_stage_items_in_total{stage="平方 \"sq\"\\\n"} 0`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("missing %s in:\n%s", want, buf.String())
+	}
+}
+
+// runningTotal 输出到目前为止的累加值，状态如果在 checkpoint 之后丢了，后面的输出就都错了
+type runningTotal struct {
+	Total int `json:"total"`
+}
+
+func (s *runningTotal) Process(ctx context.Context, n int) []int {
+	s.Total += n
+	return []int{s.Total}
+}
+
+func (s *runningTotal) Finish() []int                       { return nil }
+func (s *runningTotal) Snapshot() (json.RawMessage, error)  { return json.Marshal(s) }
+func (s *runningTotal) Restore(state json.RawMessage) error { return json.Unmarshal(state, s) }
+
+func checkpointStages(crashAt int, crash func()) []CheckpointStage {
+	crashing := Map(func(n int) int {
+		if n == crashAt {
+			crash()
+		}
+		return n
+	})
+	return []CheckpointStage{
+		{"odd", Stateless(odd)},
+		{"crash", Stateless(crashing)},
+		{"running", &runningTotal{}},
+		{"sum", &SumStage{}},
+	}
+}
+
+// collect 读完 resumablePipeline 的输出，开始之前的错误和运行中的错误都通过 error 返回
+func collect(r *PipelineResult, err error) ([]int, error) {
+	if err != nil {
+		return nil, err
+	}
+	var got []int
+	for n := range r.Out {
+		got = append(got, n)
+	}
+	return got, r.Err()
+}
+
+func TestResumablePipelineResumesStatefulStages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	nums := makeRange(1, 1000)
+	want, err := collect(resumablePipeline(context.Background(), nums, path, 7, checkpointStages(0, nil)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := collect(resumablePipeline(ctx, nums, path, 7, checkpointStages(501, cancel)...)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("crashed run: got %v, want context.Canceled", err)
+	}
+	cp, err := loadCheckpoint(path)
+	if err != nil || cp == nil || cp.Offset == 0 || cp.Offset > 501 {
+		t.Fatalf("checkpoint after crash: %+v, %v", cp, err)
+	}
+
+	got, err := collect(resumablePipeline(context.Background(), nums, path, 7, checkpointStages(0, nil)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只比较最后的和：checkpoint 之后到挂掉之前的 running 输出会重复一遍，但 sum 的状态是从 checkpoint 恢复的
+	if got[len(got)-1] != want[len(want)-1] {
+		t.Fatalf("resumed sum = %d, want %d", got[len(got)-1], want[len(want)-1])
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("checkpoint not removed after a complete run: %v", err)
+	}
+}
+
+func TestResumablePipelineRejectsMismatchedCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	ctx, cancel := context.WithCancel(context.Background())
+	collect(resumablePipeline(ctx, makeRange(1, 100), path, 5, checkpointStages(51, cancel)...))
+
+	if _, err := resumablePipeline(context.Background(), makeRange(1, 101), path, 5, checkpointStages(0, nil)...); err == nil {
+		t.Fatal("resumed with different input")
+	}
+	stages := checkpointStages(0, nil)[1:]
+	if _, err := resumablePipeline(context.Background(), makeRange(1, 100), path, 5, stages...); err == nil {
+		t.Fatal("resumed with different stages")
+	}
+}
+
+func TestBroadcastStopsOnCancel(t *testing.T) {
+	for _, policy := range []SlowPolicy{BlockSlow, DropSlow, DisconnectSlow} {
+		ctx, cancel := context.WithCancel(context.Background())
+		// in 一直有数据，也一直不关闭，订阅者也都不读
+		in := make(chan int)
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case in <- i:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		outs := Broadcast(ctx, in, 3, -1, policy)
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		for i, out := range outs {
+			deadline := time.After(time.Second)
+		drain:
+			for {
+				select {
+				case _, ok := <-out:
+					if !ok {
+						break drain
+					}
+				case <-deadline:
+					t.Fatalf("policy %d: subscriber %d not closed after cancel", policy, i)
+				}
+			}
+		}
+	}
+	if outs := Broadcast(context.Background(), echo(context.Background(), nil), -1, 0, DropSlow); len(outs) != 0 {
+		t.Fatalf("Broadcast with n = -1 returned %d subscribers", len(outs))
+	}
+}
+
+func TestLoadPipelineConfigRejectsUnknownStages(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"ok.yaml":      "source: {min: 1, max: 10}\nstages: [odd, sq]\nmerge_stages: [sum]\n",
+		"stages.yaml":  "source: {min: 1, max: 10}\nstages: [odd, square]\n",
+		"merge.json":   `{"source": {"min": 1, "max": 10}, "stages": ["sq"], "merge_stages": ["total"]}`,
+		"reverse.json": `{"source": {"min": 10, "max": 1}}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadPipelineConfig(path)
+		if (err == nil) != (name == "ok.yaml") {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
+
+func TestTryPipelinePolicies(t *testing.T) {
+	errOdd := errors.New("odd")
+	half := TryStage{"half", func(n int) (int, error) {
+		if n%2 != 0 {
+			return 0, errOdd
+		}
+		return n / 2, nil
+	}}
+	inc := TryStage{"inc", func(n int) (int, error) { return n + 1, nil }}
+
+	tests := []struct {
+		policy   ErrPolicy
+		maxOut   int // Out 最多能读到的元素个数
+		wantOut  int // -1 表示不检查确切的个数
+		wantErrs int
+		wantDead int
+	}{
+		{FailFast, 49, -1, 1, 0},
+		{SkipErrors, 50, 50, 50, 0},
+		{DeadLetter, 50, 50, 0, 50},
+	}
+	for _, tt := range tests {
+		r := tryPipeline(context.Background(), makeRange(1, 100), tt.policy, half, inc)
+		var out []int
+		var dead []*StageError
+		for outCh, deadCh := r.Out, r.DeadLetter; outCh != nil || deadCh != nil; {
+			select {
+			case n, ok := <-outCh:
+				if !ok {
+					outCh = nil
+					continue
+				}
+				out = append(out, n)
+			case se, ok := <-deadCh:
+				if !ok {
+					deadCh = nil
+					continue
+				}
+				dead = append(dead, se)
+			}
+		}
+		if len(out) > tt.maxOut || (tt.wantOut >= 0 && len(out) != tt.wantOut) {
+			t.Errorf("policy %d: got %d items", tt.policy, len(out))
+		}
+		if errs := r.Errors(); len(errs) != tt.wantErrs {
+			t.Errorf("policy %d: got %d errors, want %d", tt.policy, len(errs), tt.wantErrs)
+		}
+		if len(dead) != tt.wantDead {
+			t.Errorf("policy %d: got %d dead letters, want %d", tt.policy, len(dead), tt.wantDead)
+		}
+		for _, se := range dead {
+			if se.Stage != "half" || se.Item%2 == 0 || !errors.Is(se, errOdd) {
+				t.Errorf("policy %d: unexpected dead letter %v", tt.policy, se)
+			}
+		}
+		if tt.policy == FailFast && !errors.Is(r.Err(), errOdd) {
+			t.Errorf("FailFast: Err() = %v", r.Err())
+		}
+	}
+}
+
+func TestSuperviseRestartsThenGivesUp(t *testing.T) {
+	ctx := context.Background()
+	// 遇到 5 的倍数就 panic，重启 3 次之后第 4 次 panic 就放弃，也就是 5、10、15、20 这四个元素上
+	fragile := mapBody(func(n int) int {
+		if n%5 == 0 {
+			panic(fmt.Sprintf("bad %d", n))
+		}
+		return n
+	})
+	var mu sync.Mutex
+	var errs []error
+	onError := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+	policy := RestartPolicy{MaxRestarts: 3, Backoff: 5 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	supervised := supervise("fragile", fragile, policy, onError)
+
+	start := time.Now()
+	merged := merge(ctx, []<-chan int{
+		supervised(ctx, echo(ctx, makeRange(1, 100))),
+		echo(ctx, makeRange(1, 10)),
+	})
+	done := make(chan int)
+	go func() { done <- countInts(merged) }()
+	var n int
+	select {
+	case n = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("merge did not close after the stage gave up")
+	}
+	// 放弃之前 1..19 里不是 5 的倍数的 16 个元素，加上另一路的 10 个
+	if n != 26 {
+		t.Fatalf("got %d items, want 26", n)
+	}
+	// 三次重启之前分别等了 5ms、10ms、10ms
+	if d := time.Since(start); d < 25*time.Millisecond {
+		t.Fatalf("finished in %v, restarts did not back off", d)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != policy.MaxRestarts+2 {
+		t.Fatalf("got %d errors, want %d panics and one give-up: %v", len(errs), policy.MaxRestarts+1, errs)
+	}
+	for i, err := range errs[:policy.MaxRestarts+1] {
+		var pe *PanicError
+		if !errors.As(err, &pe) {
+			t.Fatalf("error %d = %v, want *PanicError", i, err)
+		}
+		if want := fmt.Sprintf("bad %d", (i+1)*5); pe.Stage != "fragile" || pe.Value != want || !strings.Contains(string(pe.Stack), "runProtected") {
+			t.Fatalf("error %d = %+v, want a panic with %q and a stack", i, pe, want)
+		}
+	}
+	if !strings.Contains(errs[len(errs)-1].Error(), "giving up after 3 restarts") {
+		t.Fatalf("last error = %v", errs[len(errs)-1])
+	}
+}
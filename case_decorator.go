@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"reflect"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -54,10 +59,357 @@ func Sum2(start, end int64) int64 {
 	return (end - start + 1) * (end + start) / 2
 }
 
+/*********************************************** 泛型装饰器 */
+
+/**
+上面的 decorator() 只能装饰 func(string)，timedSumFunc() 只能装饰 SumFunc，换一个函数签名就要再写一遍。
+有了泛型，一个 Decorator[A, R] 可以装饰任意的 func(A) R，计时、日志、重试、缓存这些只需要写一次：
+1. Wrap(f, d1, d2, d3) 等价于 d1(d2(d3(f)))，写在前面的在最外层，和 case_decorator_http.go 里的 Handler() 一样；
+2. 返回 (R, error) 的函数用 WrapErr()，两个返回值被打包成一个 Result[R]，所以同样的 Decorator 也能用在它上面，
+   Retry 这种要看 error 的装饰器就是 Decorator[A, Result[R]]，见下一部分；
+3. 多个参数的函数先用 Tuple() 把参数打包成一个 Pair，装饰完再用 Untuple() 拆开。
+Go 的泛型不能从返回值推导类型参数，所以 Timed、Logged 这些在使用时要写上类型参数，比如 Timed[int, int]("square")。
+*/
+
+type Decorator[A, R any] func(func(A) R) func(A) R
+
+func Wrap[A, R any](f func(A) R, ds ...Decorator[A, R]) func(A) R {
+	for i := len(ds) - 1; i >= 0; i-- {
+		f = ds[i](f)
+	}
+	return f
+}
+
+type Result[R any] struct {
+	Value R
+	Err   error
+}
+
+func (r Result[R]) Failed() bool {
+	return r.Err != nil
+}
+
+func WrapErr[A, R any](f func(A) (R, error), ds ...Decorator[A, Result[R]]) func(A) (R, error) {
+	g := Wrap(func(a A) Result[R] {
+		v, err := f(a)
+		return Result[R]{v, err}
+	}, ds...)
+	return func(a A) (R, error) {
+		r := g(a)
+		return r.Value, r.Err
+	}
+}
+
+type Pair[A, B any] struct {
+	First  A
+	Second B
+}
+
+func Tuple[A, B, R any](f func(A, B) R) func(Pair[A, B]) R {
+	return func(p Pair[A, B]) R {
+		return f(p.First, p.Second)
+	}
+}
+
+func Untuple[A, B, R any](f func(Pair[A, B]) R) func(A, B) R {
+	return func(a A, b B) R {
+		return f(Pair[A, B]{a, b})
+	}
+}
+
+// failer 是 Result 实现的接口，Cached 靠它判断一次调用有没有失败，失败的结果不缓存
+type failer interface {
+	Failed() bool
+}
+
+func failed(r interface{}) bool {
+	f, ok := r.(failer)
+	return ok && f.Failed()
+}
+
+func Timed[A, R any](name string) Decorator[A, R] {
+	return func(f func(A) R) func(A) R {
+		return func(a A) R {
+			defer func(t time.Time) {
+				fmt.Printf("--- Time Elapsed (%s): %v ---\n", name, time.Since(t))
+			}(time.Now())
+			return f(a)
+		}
+	}
+}
+
+func Logged[A, R any](name string) Decorator[A, R] {
+	return func(f func(A) R) func(A) R {
+		return func(a A) R {
+			fmt.Printf("%s(%+v) started\n", name, a)
+			r := f(a)
+			fmt.Printf("%s(%+v) = %+v\n", name, a, r)
+			return r
+		}
+	}
+}
+
+// Cached 记住每个参数的结果，失败的结果不缓存，下次还会重新调用，可以在多个 Go Routine 里同时使用
+func Cached[A comparable, R any]() Decorator[A, R] {
+	return func(f func(A) R) func(A) R {
+		var mu sync.Mutex
+		cache := map[A]R{}
+		return func(a A) R {
+			mu.Lock()
+			r, ok := cache[a]
+			mu.Unlock()
+			if ok {
+				return r
+			}
+			r = f(a)
+			if !failed(r) {
+				mu.Lock()
+				cache[a] = r
+				mu.Unlock()
+			}
+			return r
+		}
+	}
+}
+
+/*********************************************** 重试 */
+
+/**
+RetryPolicy 描述怎么重试：
+1. 最多调用 MaxAttempts 次（包括第一次），小于 1 时按 1 次算；
+2. 第 n 次重试之前的等待时间是指数退避加 full jitter：在 [0, min(MaxDelay, BaseDelay * 2^(n-1))] 里随机取一个值，
+   这样同时失败的很多客户端不会在同一时刻一起重试；
+3. 等待的时候 ctx 被取消就马上返回，不会等满；
+4. Retryable 决定一个 error 值不值得重试，没有设置时除了 ctx 被取消和超时，其它 error 都重试；
+5. Clock 和 Rand 用来在测试里替换掉真实的时间和随机数，FakeClock 的 After 不会真的等待，只记下要等多久。
+
+Do() 是重试的核心逻辑，Retry[T]() 是用在 WrapErr 上的 Decorator，RetryFunc() 装饰 func(ctx) error。
+*/
+
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock 的 After 马上返回，时间直接往前拨 d，可以在多个 Go Routine 里同时使用
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.sleeps = append(c.sleeps, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleeps 返回每次 After 被调用时要求等待的时间
+func (c *FakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration // 0 表示不设上限
+	Retryable   func(error) bool
+	Clock       Clock      // nil 时用真实的时间
+	Rand        *rand.Rand // nil 时用 math/rand 的全局随机数，*rand.Rand 不能在多个 Go Routine 里同时使用
+}
+
+// RetryError 是重试了 MaxAttempts 次之后还是失败时返回的错误，Err 是最后一次的错误
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// backoff 返回第 retry 次重试之前要等待的时间，retry 从 1 开始
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	// BaseDelay * 2^(retry-1) 会溢出时按 int64 的最大值算，再交给 MaxDelay 去截断
+	d := time.Duration(math.MaxInt64)
+	if shift := retry - 1; shift < 63 && p.BaseDelay <= math.MaxInt64>>shift {
+		d = p.BaseDelay << shift
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	// 随机数的范围是 [0, d]，d 已经是最大值时只能取到 d-1
+	n := int64(d)
+	if n < math.MaxInt64 {
+		n++
+	}
+	if p.Rand != nil {
+		return time.Duration(p.Rand.Int63n(n))
+	}
+	return time.Duration(rand.Int63n(n))
+}
+
+// Do 调用 f 直到成功、遇到不可重试的错误、次数用完或者 ctx 被取消，
+// 不可重试的错误原样返回，ctx 被取消时返回 ctx.Err()
+func (p RetryPolicy) Do(ctx context.Context, f func(context.Context) error) error {
+	clock := p.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	attempts := p.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := f(ctx)
+		if err == nil || !p.retryable(err) {
+			return err
+		}
+		if attempt == attempts {
+			return &RetryError{attempt, err}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-clock.After(p.backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func Retry[T any](p RetryPolicy) Decorator[context.Context, Result[T]] {
+	return func(f func(context.Context) Result[T]) func(context.Context) Result[T] {
+		return func(ctx context.Context) Result[T] {
+			var r Result[T]
+			err := p.Do(ctx, func(ctx context.Context) error {
+				r = f(ctx)
+				return r.Err
+			})
+			return Result[T]{r.Value, err}
+		}
+	}
+}
+
+func RetryFunc(p RetryPolicy) func(func(context.Context) error) func(context.Context) error {
+	return func(f func(context.Context) error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			return p.Do(ctx, f)
+		}
+	}
+}
+
 func main() {
 	decorator(Hello)("Hello, World!")
 
 	sum1 := timedSumFunc(Sum1)
 	sum2 := timedSumFunc(Sum2)
 	fmt.Printf("%d, %d\n", sum1(-10000, 10000000), sum2(-10000, 10000000))
+
+	/**
+	同一个 Timed 装饰两个参数的 Sum1，再加上缓存，第二次调用直接返回缓存的结果
+	*/
+	sum3 := Untuple(Wrap(Tuple(Sum1),
+		Timed[Pair[int64, int64], int64]("Sum1"),
+		Cached[Pair[int64, int64], int64](),
+	))
+	fmt.Println(sum3(-10000, 10000000), sum3(-10000, 10000000))
+
+	/**
+	返回 error 的函数：前两次失败，Retry 重试到第三次成功，Logged 在最外层只看到最后的结果；
+	用 FakeClock 不会真的等待，随机数固定了种子，每次运行等待的时间都一样
+	*/
+	errUnavailable := errors.New("temporarily unavailable")
+	calls := 0
+	flaky := func(ctx context.Context) (string, error) {
+		calls++
+		if calls < 3 {
+			return "", errUnavailable
+		}
+		return "Hello, World", nil
+	}
+	clock := NewFakeClock(time.Now())
+	policy := RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+		Clock:       clock,
+		Rand:        rand.New(rand.NewSource(1)),
+	}
+	greet := WrapErr(flaky,
+		Logged[context.Context, Result[string]]("greet"),
+		Retry[string](policy),
+	)
+	msg, err := greet(context.Background())
+	fmt.Println(msg, err, "calls:", calls, "sleeps:", clock.Sleeps())
+
+	/**
+	一直失败：重试 MaxAttempts 次之后放弃，每次等待的时间都不超过 MaxDelay；
+	不可重试的错误调用一次就返回
+	*/
+	clock = NewFakeClock(time.Now())
+	policy.Clock = clock
+	policy.Retryable = func(err error) bool { return errors.Is(err, errUnavailable) }
+	calls = 0
+	alwaysFail := RetryFunc(policy)(func(ctx context.Context) error {
+		calls++
+		return errUnavailable
+	})
+	err = alwaysFail(context.Background())
+	fmt.Println(err, errors.Is(err, errUnavailable), "calls:", calls, "sleeps:", clock.Sleeps())
+
+	calls = 0
+	errNotFound := errors.New("not found")
+	err = RetryFunc(policy)(func(ctx context.Context) error {
+		calls++
+		return errNotFound
+	})(context.Background())
+	fmt.Println(err, "calls:", calls)
+
+	/**
+	用真实的时间，每次要等好几秒，但 ctx 50ms 之后就超时了，Do 马上返回而不是等到下一次重试
+	*/
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = RetryPolicy{MaxAttempts: 10, BaseDelay: 5 * time.Second}.Do(ctx, func(ctx context.Context) error {
+		return errUnavailable
+	})
+	fmt.Println(err, time.Since(start) < time.Second)
 }
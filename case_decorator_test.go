@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errTemporary = errors.New("temporary")
+
+// trace 记下装饰器进入和退出的顺序
+func trace(name string, calls *[]string) Decorator[int, int] {
+	return func(f func(int) int) func(int) int {
+		return func(n int) int {
+			*calls = append(*calls, name+" in")
+			defer func() { *calls = append(*calls, name+" out") }()
+			return f(n)
+		}
+	}
+}
+
+func TestWrapOrder(t *testing.T) {
+	var calls []string
+	f := Wrap(func(n int) int {
+		calls = append(calls, "f")
+		return n * n
+	}, trace("d1", &calls), trace("d2", &calls), trace("d3", &calls))
+	if got := f(3); got != 9 {
+		t.Fatalf("f(3) = %d", got)
+	}
+	want := []string{"d1 in", "d2 in", "d3 in", "f", "d3 out", "d2 out", "d1 out"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestCachedSkipsFailedResults(t *testing.T) {
+	calls := map[int]int{}
+	f := WrapErr(func(n int) (int, error) {
+		calls[n]++
+		if n < 0 {
+			return 0, errTemporary
+		}
+		return n * 2, nil
+	}, Cached[int, Result[int]]())
+	for i := 0; i < 3; i++ {
+		if v, err := f(21); v != 42 || err != nil {
+			t.Fatalf("f(21) = %d, %v", v, err)
+		}
+		if _, err := f(-1); err != errTemporary {
+			t.Fatalf("f(-1) error = %v", err)
+		}
+	}
+	if calls[21] != 1 || calls[-1] != 3 {
+		t.Fatalf("calls = %v, want 21 cached after one call and -1 called every time", calls)
+	}
+}
+
+func TestTupleUntuple(t *testing.T) {
+	sum := Untuple(Wrap(Tuple(Sum2), Cached[Pair[int64, int64], int64]()))
+	if got := sum(1, 100); got != 5050 {
+		t.Fatalf("sum(1, 100) = %d", got)
+	}
+}
+
+func TestBackoffWithoutCapDoesNotCollapse(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, Rand: rand.New(rand.NewSource(1))}
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 0, time.Second},
+		{4, 0, 8 * time.Second},
+		{34, 0, time.Second << 33},
+		// 从第 35 次开始 1s * 2^34 已经溢出 int64，上限是 MaxInt64，随机到一个小于一小时的值几乎不可能
+		{35, time.Hour, math.MaxInt64},
+		{40, time.Hour, math.MaxInt64},
+		{63, time.Hour, math.MaxInt64},
+		{64, time.Hour, math.MaxInt64},
+		{1000, time.Hour, math.MaxInt64},
+	}
+	for _, tt := range tests {
+		if d := p.backoff(tt.retry); d < tt.min || d > tt.max {
+			t.Fatalf("backoff(%d) = %v, want within [%v, %v]", tt.retry, d, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetrySleepsWithinJitterBounds(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	p := RetryPolicy{
+		MaxAttempts: 8,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+		Clock:       clock,
+		Rand:        rand.New(rand.NewSource(1)),
+	}
+	calls := 0
+	err := p.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errTemporary
+	})
+
+	var re *RetryError
+	if !errors.As(err, &re) || re.Attempts != 8 || !errors.Is(err, errTemporary) {
+		t.Fatalf("got %v, want RetryError after 8 attempts wrapping errTemporary", err)
+	}
+	if calls != 8 {
+		t.Fatalf("calls = %d, want 8", calls)
+	}
+	sleeps := clock.Sleeps()
+	if len(sleeps) != 7 {
+		t.Fatalf("sleeps = %v, want 7", sleeps)
+	}
+	// 100ms 每次翻倍，到 1s 之后就被 MaxDelay 截住
+	bounds := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+		time.Second, time.Second, time.Second,
+	}
+	var total time.Duration
+	for i, d := range sleeps {
+		if d < 0 || d > bounds[i] {
+			t.Fatalf("sleep %d = %v, want within [0, %v]", i+1, d, bounds[i])
+		}
+		total += d
+	}
+	if got := clock.Now().Sub(time.Unix(0, 0)); got != total {
+		t.Fatalf("fake clock advanced %v, want %v", got, total)
+	}
+}
+
+func TestRetryNonRetryable(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	errFatal := errors.New("fatal")
+	p := RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		Clock:       clock,
+		Retryable:   func(err error) bool { return errors.Is(err, errTemporary) },
+	}
+	calls := 0
+	err := p.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		return errFatal
+	})
+	if err != errFatal || calls != 1 || len(clock.Sleeps()) != 0 {
+		t.Fatalf("got %v after %d calls and sleeps %v, want errFatal after 1 call", err, calls, clock.Sleeps())
+	}
+}
+
+// cancelClock 在开始等待的时候取消 ctx，而且永远不会到时间，Do 只能从 ctx.Done() 返回
+type cancelClock struct {
+	cancel context.CancelFunc
+}
+
+func (c cancelClock) After(d time.Duration) <-chan time.Time {
+	c.cancel()
+	return make(chan time.Time)
+}
+
+func TestRetryCancelledDuringWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, Clock: cancelClock{cancel}}
+	calls := 0
+	err := p.Do(ctx, func(ctx context.Context) error {
+		calls++
+		return errTemporary
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("got %v after %d calls, want context.Canceled after 1 call", err, calls)
+	}
+}
+
+func TestRetryDecorator(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	calls := 0
+	flaky := func(ctx context.Context) (int, error) {
+		calls++
+		if calls < 3 {
+			return 0, errTemporary
+		}
+		return 42, nil
+	}
+	f := WrapErr(flaky, Retry[int](RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, Clock: clock}))
+	v, err := f(context.Background())
+	if v != 42 || err != nil || calls != 3 || len(clock.Sleeps()) != 2 {
+		t.Fatalf("got %d, %v after %d calls and sleeps %v", v, err, calls, clock.Sleeps())
+	}
+}
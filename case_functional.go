@@ -1,8 +1,37 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"geekbang/options"
 )
 
 /*********************************************** 1 */
@@ -135,48 +164,1571 @@ type Server struct {
 	Timeout  time.Duration
 	MaxConns int
 	TLS      *tls.Config
+	Handler  ConnHandler
+
+	// 按客户端 IP 的限制，见第 12 部分，零值表示不限制
+	MaxConnsPerIP int
+	AcceptRate    float64
+	AcceptBurst   int
+	ReapIdle      bool
+
+	// 每个字段的值来自哪里，以及正在应用的 Option 来自哪里
+	origins      map[string]fieldOrigin
+	applying     Source
+	applyingName string
+
+	// 下面是 Start 之后的运行状态
+	mu       sync.Mutex
+	stopping bool // Shutdown 已经开始
+	listener net.Listener
+	packet   net.PacketConn
+	conns    map[*deadlineConn]string // 连接 -> clientKey
+	clients  map[string]*clientState
+	retained map[string]ClientStats // 被清理掉的客户端里被限制过的那些
+	limiter  *connLimiter
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
 }
 
-type Option func(*Server)
+/**
+Option 也可以返回 error：参数不合法时不修改 Server，而是返回一个 FieldError。
+NewServer 不会在第一个错误就停下来，而是把所有 Option 的错误和最后对整个 Server 的检查结果汇总到一个 ValidationError 里，
+这样配置写错了，启动的时候就能一次看到所有写错的字段。
 
-func Protocol(p string) Option {
-	return func(s *Server) {
-		s.Protocol = p
+Option 现在是通用的 options.Option[Server]，见第 10 部分。
+*/
+
+type Option = options.Option[Server]
+
+type FieldError struct {
+	Field string
+	Value interface{}
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s (got %v)", e.Field, e.Msg, e.Value)
+}
+
+type ValidationError struct {
+	Fields []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid server config: %d field error(s)", len(e.Fields))
+	for _, f := range e.Fields {
+		b.WriteString("\n  ")
+		b.WriteString(f.Error())
 	}
+	return b.String()
+}
+
+var protocols = map[string]bool{
+	"tcp": true, "tcp4": true, "tcp6": true,
+	"udp": true, "udp4": true, "udp6": true,
+	"unix": true,
+}
+
+func Protocol(p string) Option {
+	return Named(fmt.Sprintf("Protocol(%q)", p), func(s *Server) error {
+		if !protocols[p] {
+			return &FieldError{"Protocol", p, "unknown protocol"}
+		}
+		s.set("Protocol", func() { s.Protocol = p })
+		return nil
+	})
 }
 func Timeout(timeout time.Duration) Option {
-	return func(s *Server) {
-		s.Timeout = timeout
-	}
+	return Named(fmt.Sprintf("Timeout(%v)", timeout), func(s *Server) error {
+		if timeout <= 0 {
+			return &FieldError{"Timeout", timeout, "must be positive"}
+		}
+		s.set("Timeout", func() { s.Timeout = timeout })
+		return nil
+	})
 }
 func MaxConns(maxconns int) Option {
-	return func(s *Server) {
-		s.MaxConns = maxconns
-	}
+	return Named(fmt.Sprintf("MaxConns(%d)", maxconns), func(s *Server) error {
+		if maxconns <= 0 {
+			return &FieldError{"MaxConns", maxconns, "must be positive"}
+		}
+		s.set("MaxConns", func() { s.MaxConns = maxconns })
+		return nil
+	})
 }
 func TLS(tls *tls.Config) Option {
-	return func(s *Server) {
-		s.TLS = tls
-	}
+	return Named("TLS(...)", func(s *Server) error {
+		s.set("TLS", func() { s.TLS = tls })
+		return nil
+	}).Exclusive("certificate")
+}
+func Handler(h ConnHandler) Option {
+	return Named(fmt.Sprintf("Handler(%T)", h), func(s *Server) error {
+		if h == nil {
+			return &FieldError{"Handler", h, "must not be nil"}
+		}
+		s.set("Handler", func() { s.Handler = h })
+		return nil
+	})
 }
 
-func NewServer(addr string, port int, options ...func(*Server)) (*Server, error) {
+// validate 检查 Option 管不到的必填字段，以及 Option 之外被直接改坏的字段
+func (s *Server) validate() []*FieldError {
+	var errs []*FieldError
+	if s.Addr == "" {
+		errs = append(errs, &FieldError{"Addr", s.Addr, "is required"})
+	}
+	// unix socket 的 Addr 是文件路径，不需要端口
+	if s.Protocol != "unix" && (s.Port < 0 || s.Port > 65535) {
+		errs = append(errs, &FieldError{"Port", s.Port, "must be between 0 and 65535"})
+	}
+	if !protocols[s.Protocol] {
+		errs = append(errs, &FieldError{"Protocol", s.Protocol, "unknown protocol"})
+	}
+	if s.Timeout <= 0 {
+		errs = append(errs, &FieldError{"Timeout", s.Timeout, "must be positive"})
+	}
+	if s.MaxConns <= 0 {
+		errs = append(errs, &FieldError{"MaxConns", s.MaxConns, "must be positive"})
+	}
+	if s.MaxConnsPerIP < 0 {
+		errs = append(errs, &FieldError{"MaxConnsPerIP", s.MaxConnsPerIP, "must not be negative"})
+	}
+	if s.AcceptRate < 0 {
+		errs = append(errs, &FieldError{"AcceptRate", s.AcceptRate, "must not be negative"})
+	}
+	if s.AcceptRate > 0 && s.AcceptBurst < 1 {
+		errs = append(errs, &FieldError{"AcceptBurst", s.AcceptBurst, "must be at least 1"})
+	}
+	return errs
+}
 
-	srv := Server{
-		Addr:     addr,
-		Port:     port,
-		Protocol: "tcp",
-		Timeout:  30 * time.Second,
-		MaxConns: 1000,
-		TLS:      nil,
+func NewServer(addr string, port int, opts ...Option) (*Server, error) {
+	var srv Server
+	defaults := func(s *Server) {
+		s.Addr = addr
+		s.Port = port
+		s.Protocol = "tcp"
+		s.Timeout = 30 * time.Second
+		s.MaxConns = 1000
+		s.TLS = nil
+		// addr 和 port 是调用者明确传进来的，记为 SourceArgument，和写死的默认值区分开
+		name := fmt.Sprintf("NewServer(%q, %d)", addr, port)
+		s.origins = map[string]fieldOrigin{
+			"Addr": {SourceArgument, name},
+			"Port": {SourceArgument, name},
+		}
+		s.applying = SourceCode
+	}
+	errs := fieldErrors(options.Apply(&srv, defaults, opts...))
+	// 有互斥的 Option 时 defaults 都没有执行，也就没必要再检查了
+	if srv.origins != nil {
+		errs = append(errs, srv.validate()...)
 	}
-	for _, option := range options {
-		option(&srv)
+	if len(errs) > 0 {
+		return nil, &ValidationError{errs}
 	}
-	//...
 	return &srv, nil
 }
 
+// fieldErrors 把 options.Apply 返回的错误展开成 FieldError
+func fieldErrors(err error) []*FieldError {
+	if err == nil {
+		return nil
+	}
+	var errs []*FieldError
+	var all options.Errors
+	if !errors.As(err, &all) {
+		all = options.Errors{err}
+	}
+	for _, err := range all {
+		var ve *ValidationError
+		var fe *FieldError
+		var ee *options.ExclusiveError
+		switch {
+		case errors.As(err, &ve):
+			errs = append(errs, ve.Fields...)
+		case errors.As(err, &fe):
+			errs = append(errs, fe)
+		case errors.As(err, &ee):
+			errs = append(errs, &FieldError{"Option", ee.Options, "mutually exclusive (" + ee.Key + ")"})
+		default:
+			errs = append(errs, &FieldError{"Option", nil, err.Error()})
+		}
+	}
+	return errs
+}
+
+/*********************************************** 5 */
+/**
+监听和服务
+
+前面的 Server 只是一个结构体，Start() 才真正在 Addr:Port 上监听：
+1. Protocol 选择 tcp、udp 或者 unix（unix 时 Addr 就是 socket 文件的路径）；
+2. TLS 不为 nil 时，tcp/unix 上 Accept 到的连接会用 tls.Server 包装，udp 不支持 TLS；
+3. Timeout 作为每次读写的 deadline，一个连接空闲超过 Timeout 就会读写失败；
+4. MaxConns 用一个带缓冲的 Channel 做信号量，连接数满了就先不 Accept，udp 则是限制同时处理的数据包数。
+每个连接交给 Handler 处理，udp 的每个数据包会被包装成一个只读一次的 net.Conn，写回去就是回给发送方。
+
+Start() 的 ctx 被取消时，listener 会被关闭，所有连接的 ctx 也都会被取消。
+Shutdown() 先关闭 listener 不再接受新连接，然后等正在处理的连接结束，等到 ctx 超时就强制关闭剩下的连接。
+*/
+
+type ConnHandler interface {
+	ServeConn(ctx context.Context, conn net.Conn)
+}
+
+type ConnHandlerFunc func(ctx context.Context, conn net.Conn)
+
+func (f ConnHandlerFunc) ServeConn(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+func (s *Server) address() string {
+	if s.Protocol == "unix" {
+		return s.Addr
+	}
+	return net.JoinHostPort(s.Addr, strconv.Itoa(s.Port))
+}
+
+func isPacketProtocol(protocol string) bool {
+	return strings.HasPrefix(protocol, "udp")
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Handler == nil {
+		return errors.New("server: no Handler")
+	}
+	if s.cancel != nil {
+		return errors.New("server: already started")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.limiter = newConnLimiter(s.MaxConns)
+	s.conns = make(map[*deadlineConn]string)
+	s.clients = make(map[string]*clientState)
+	s.retained = make(map[string]ClientStats)
+	if err := s.listen(ctx, s); err != nil {
+		cancel()
+		return err
+	}
+	s.ctx, s.cancel = ctx, cancel
+	go s.reapIdle(ctx)
+
+	go func() {
+		<-ctx.Done()
+		s.closeListener()
+	}()
+	return nil
+}
+
+// listen 按 conf 的 Protocol、Addr、Port 和 TLS 打开一个新的 listener 并开始服务，调用时要持有 s.mu
+func (s *Server) listen(ctx context.Context, conf *Server) error {
+	if isPacketProtocol(conf.Protocol) {
+		if conf.TLS != nil {
+			return fmt.Errorf("server: TLS is not supported over %s", conf.Protocol)
+		}
+		pc, err := net.ListenPacket(conf.Protocol, conf.address())
+		if err != nil {
+			return err
+		}
+		s.listener, s.packet = nil, pc
+		s.wg.Add(1)
+		go s.servePackets(ctx, pc)
+		return nil
+	}
+	ln, err := net.Listen(conf.Protocol, conf.address())
+	if err != nil {
+		return err
+	}
+	ln = &tlsListener{Listener: ln, config: s.currentTLS}
+	s.listener, s.packet = ln, nil
+	s.wg.Add(1)
+	go s.serveStream(ctx, ln)
+	return nil
+}
+
+// ListenAddr 返回实际监听的地址，Port 为 0 时可以用它拿到系统分配的端口
+func (s *Server) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return s.listener.Addr()
+	}
+	if s.packet != nil {
+		return s.packet.LocalAddr()
+	}
+	return nil
+}
+
+// tlsListener 在 Accept 的时候才去取 TLS 配置，所以 Reload 修改 TLS（包括打开和关闭 TLS）都不用重新监听
+type tlsListener struct {
+	net.Listener
+	config func() *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if conf := l.config(); conf != nil {
+		return tls.Server(conn, conf), nil
+	}
+	return conn, nil
+}
+
+func (s *Server) currentTLS() *tls.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.TLS
+}
+
+func (s *Server) closeListener() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.packet != nil {
+		s.packet.Close()
+	}
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.stopping = cancel != nil
+	s.mu.Unlock()
+	if cancel == nil {
+		return errors.New("server: not started")
+	}
+	s.closeListener()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	// 等不及了，取消所有连接的 ctx 并强制关闭连接
+	cancel()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// connConfig 返回处理一个新连接时用到的配置，Reload 可能随时修改它们
+func (s *Server) connConfig() (ConnHandler, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Handler, s.Timeout
+}
+
+func (s *Server) currentTimeout() time.Duration {
+	_, timeout := s.connConfig()
+	return timeout
+}
+
+func (s *Server) serveStream(ctx context.Context, ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		if !s.limiter.acquire(ctx) {
+			return
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			s.limiter.release()
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("server: accept:", err)
+			}
+			return
+		}
+		s.wg.Add(1)
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer s.wg.Done()
+	defer s.limiter.release()
+	client := clientKey(conn.RemoteAddr())
+	if !s.admit(client) {
+		conn.Close()
+		return
+	}
+	dc := &deadlineConn{Conn: conn, timeout: s.currentTimeout}
+	dc.touch()
+	s.mu.Lock()
+	s.conns[dc] = client
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, dc)
+		s.mu.Unlock()
+		s.leave(client)
+		conn.Close()
+	}()
+	handler, _ := s.connConfig()
+	handler.ServeConn(ctx, dc)
+}
+
+func (s *Server) servePackets(ctx context.Context, pc net.PacketConn) {
+	defer s.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		if !s.limiter.acquire(ctx) {
+			return
+		}
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			s.limiter.release()
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("server: read packet:", err)
+			}
+			return
+		}
+		conn := &datagramConn{pc: pc, addr: addr, data: append([]byte(nil), buf[:n]...)}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.limiter.release()
+			client := clientKey(addr)
+			if !s.admit(client) {
+				return
+			}
+			defer s.leave(client)
+			handler, timeout := s.connConfig()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			handler.ServeConn(ctx, conn)
+		}()
+	}
+}
+
+// connLimiter 是一个可以在运行时调整大小的信号量，缩小之后已有的连接不受影响，只是新连接要等到数量降下来
+type connLimiter struct {
+	mu     sync.Mutex
+	max    int
+	active int
+	wake   chan struct{} // 有名额可能空出来时关闭并换一个新的
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, wake: make(chan struct{})}
+}
+
+func (l *connLimiter) acquire(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		if l.active < l.max {
+			l.active++
+			l.mu.Unlock()
+			return true
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.broadcast()
+}
+
+func (l *connLimiter) resize(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.broadcast()
+}
+
+func (l *connLimiter) broadcast() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// deadlineConn 在每次读写之前把 deadline 往后推 timeout()，并记下最后一次读写的时间
+type deadlineConn struct {
+	active int64 // UnixNano，用 atomic 访问，放在第一个保证 64 位对齐
+	net.Conn
+	timeout func() time.Duration
+	reaped  bool // 已经被 reapIdle 关闭，由 Server.mu 保护
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.touch()
+	defer c.touch()
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout())); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.touch()
+	defer c.touch()
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout())); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *deadlineConn) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+}
+
+func (c *deadlineConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.active)))
+}
+
+// datagramConn 把一个 udp 数据包包装成 net.Conn：Read 只能读到这一个数据包，Write 回给发送方
+type datagramConn struct {
+	pc   net.PacketConn
+	addr net.Addr
+	data []byte
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	return c.pc.WriteTo(b, c.addr)
+}
+
+func (c *datagramConn) Close() error                       { return nil }
+func (c *datagramConn) LocalAddr() net.Addr                { return c.pc.LocalAddr() }
+func (c *datagramConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *datagramConn) SetDeadline(t time.Time) error      { return nil }
+func (c *datagramConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *datagramConn) SetWriteDeadline(t time.Time) error { return nil }
+
+/*********************************************** 6 */
+/**
+配置来源
+
+除了在代码里写 Option，Server 的配置还可以来自配置文件、环境变量和命令行参数，优先级从低到高是：
+	默认值 < NewServer 的 addr 和 port 参数 < FromFile < FromEnv < FromFlags < 代码里的 Option
+NewServer 的 addr 和 port 参数是程序里写的初始值，Origins() 里记为 argument，和默认值区分开，
+但配置文件、环境变量和命令行参数都可以覆盖它们，这样部署的时候才能换监听的地址和端口。
+优先级和 Option 的先后顺序无关：一个字段被高优先级的来源设置过之后，低优先级的来源就不会再覆盖它。
+这几个来源都只能设置 Addr、Port、Protocol、Timeout 和 MaxConns，TLS 和 Handler 只能在代码里设置。
+Origins() 可以查到最后每个字段的值是从哪里来的。
+
+配置文件按扩展名区分 JSON、YAML 和 TOML，字段名是 addr、port、protocol、timeout 和 max_conns，timeout 写成 "30s" 这样的格式；
+环境变量是 <prefix>_ADDR、<prefix>_PORT、<prefix>_PROTOCOL、<prefix>_TIMEOUT 和 <prefix>_MAX_CONNS；
+命令行参数是 -addr、-port、-protocol、-timeout 和 -max-conns。
+*/
+
+type Source int
+
+const (
+	SourceDefault Source = iota
+	SourceArgument
+	SourceFile
+	SourceEnv
+	SourceFlag
+	SourceCode
+)
+
+func (src Source) String() string {
+	switch src {
+	case SourceDefault:
+		return "default"
+	case SourceArgument:
+		return "argument"
+	case SourceFile:
+		return "file"
+	case SourceEnv:
+		return "env"
+	case SourceFlag:
+		return "flag"
+	case SourceCode:
+		return "code"
+	}
+	return "Source(" + strconv.Itoa(int(src)) + ")"
+}
+
+type fieldOrigin struct {
+	Source Source
+	Option string
+}
+
+// set 只有在当前来源的优先级不低于字段原来的来源时才赋值，同时记下是哪个 Option 设置的
+func (s *Server) set(field string, assign func()) {
+	if s.origins[field].Source > s.applying {
+		return
+	}
+	assign()
+	s.origins[field] = fieldOrigin{s.applying, s.applyingName}
+}
+
+var serverFields = []string{"Addr", "Port", "Protocol", "Timeout", "MaxConns", "TLS", "Handler", "MaxConnsPerIP", "AcceptRate", "ReapIdle"}
+
+// Origins 返回每个字段的值的来源
+func (s *Server) Origins() map[string]Source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	origins := map[string]Source{}
+	for _, field := range serverFields {
+		origins[field] = s.origins[field].Source
+	}
+	return origins
+}
+
+// applyWithSource 以 src 的优先级应用 opts，所有错误合并成一个 ValidationError
+func applyWithSource(s *Server, src Source, opts ...Option) error {
+	prev := s.applying
+	s.applying = src
+	defer func() { s.applying = prev }()
+	if errs := fieldErrors(options.Apply(s, nil, opts...)); len(errs) > 0 {
+		return &ValidationError{errs}
+	}
+	return nil
+}
+
+func listenAddr(addr string) Option {
+	return Named(fmt.Sprintf("Addr(%q)", addr), func(s *Server) error {
+		s.set("Addr", func() { s.Addr = addr })
+		return nil
+	})
+}
+
+func listenPort(port int) Option {
+	return Named(fmt.Sprintf("Port(%d)", port), func(s *Server) error {
+		if port < 0 || port > 65535 {
+			return &FieldError{"Port", port, "must be between 0 and 65535"}
+		}
+		s.set("Port", func() { s.Port = port })
+		return nil
+	})
+}
+
+// serverConfig 是配置文件、环境变量和命令行参数共用的中间格式，nil 表示没有配置这个字段
+type serverConfig struct {
+	Addr     *string `json:"addr" yaml:"addr" toml:"addr"`
+	Port     *int    `json:"port" yaml:"port" toml:"port"`
+	Protocol *string `json:"protocol" yaml:"protocol" toml:"protocol"`
+	Timeout  *string `json:"timeout" yaml:"timeout" toml:"timeout"`
+	MaxConns *int    `json:"max_conns" yaml:"max_conns" toml:"max_conns"`
+}
+
+func (c *serverConfig) apply(s *Server, src Source) error {
+	var opts []Option
+	if c.Addr != nil {
+		opts = append(opts, listenAddr(*c.Addr))
+	}
+	if c.Port != nil {
+		opts = append(opts, listenPort(*c.Port))
+	}
+	if c.Protocol != nil {
+		opts = append(opts, Protocol(*c.Protocol))
+	}
+	if c.Timeout != nil {
+		timeout, err := time.ParseDuration(*c.Timeout)
+		if err != nil {
+			raw := *c.Timeout
+			opts = append(opts, options.New("Timeout", func(*Server) error {
+				return &FieldError{"Timeout", raw, "is not a duration"}
+			}))
+		} else {
+			opts = append(opts, Timeout(timeout))
+		}
+	}
+	if c.MaxConns != nil {
+		opts = append(opts, MaxConns(*c.MaxConns))
+	}
+	return applyWithSource(s, src, opts...)
+}
+
+func FromFile(path string) Option {
+	return Named(fmt.Sprintf("FromFile(%q)", path), func(s *Server) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return &FieldError{"File", path, err.Error()}
+		}
+		var c serverConfig
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			err = json.Unmarshal(data, &c)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &c)
+		case ".toml":
+			err = toml.Unmarshal(data, &c)
+		default:
+			err = errors.New("unknown config format, want .json, .yaml, .yml or .toml")
+		}
+		if err != nil {
+			return &FieldError{"File", path, err.Error()}
+		}
+		return c.apply(s, SourceFile)
+	})
+}
+
+func FromEnv(prefix string) Option {
+	return Named(fmt.Sprintf("FromEnv(%q)", prefix), func(s *Server) error {
+		var c serverConfig
+		var errs []*FieldError
+		lookup := func(name string) (string, bool) {
+			return os.LookupEnv(prefix + "_" + name)
+		}
+		lookupInt := func(field, name string) *int {
+			v, ok := lookup(name)
+			if !ok {
+				return nil
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, &FieldError{field, v, prefix + "_" + name + " is not an integer"})
+				return nil
+			}
+			return &n
+		}
+		if v, ok := lookup("ADDR"); ok {
+			c.Addr = &v
+		}
+		if v, ok := lookup("PROTOCOL"); ok {
+			c.Protocol = &v
+		}
+		if v, ok := lookup("TIMEOUT"); ok {
+			c.Timeout = &v
+		}
+		c.Port = lookupInt("Port", "PORT")
+		c.MaxConns = lookupInt("MaxConns", "MAX_CONNS")
+
+		if err := c.apply(s, SourceEnv); err != nil {
+			var ve *ValidationError
+			if errors.As(err, &ve) {
+				errs = append(errs, ve.Fields...)
+			}
+		}
+		if len(errs) > 0 {
+			return &ValidationError{errs}
+		}
+		return nil
+	})
+}
+
+// FromFlags 马上在 fs 上注册命令行参数，返回的 Option 只应用那些在命令行上出现过的参数，
+// 所以要在 fs.Parse() 之后再把它传给 NewServer。
+func FromFlags(fs *flag.FlagSet) Option {
+	addr := fs.String("addr", "", "listen address")
+	port := fs.Int("port", 0, "listen port")
+	protocol := fs.String("protocol", "", "tcp, udp or unix")
+	timeout := fs.String("timeout", "", "read/write timeout, e.g. 30s")
+	maxConns := fs.Int("max-conns", 0, "maximum concurrent connections")
+	return Named("FromFlags", func(s *Server) error {
+		var c serverConfig
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "addr":
+				c.Addr = addr
+			case "port":
+				c.Port = port
+			case "protocol":
+				c.Protocol = protocol
+			case "timeout":
+				c.Timeout = timeout
+			case "max-conns":
+				c.MaxConns = maxConns
+			}
+		})
+		return c.apply(s, SourceFlag)
+	})
+}
+
+/*********************************************** 7 */
+/**
+热加载
+
+Reload() 在运行中的 Server 上应用新的 Option，新配置不合法时返回 ValidationError，Server 保持原样：
+1. Timeout、MaxConns 和 Handler 直接生效：Timeout 从下一次读写开始生效，MaxConns 调小后已有的连接不会被断开，只是新连接要等；
+2. TLS 也是直接生效：listener 在每次 Accept 的时候才去取 TLS 配置，所以换证书、打开或者关闭 TLS 都不用重新监听，
+   在固定的端口上也不会和自己抢端口；
+3. Addr、Port 或 Protocol 变了，就先在新的地址上打开 listener 开始服务，再关闭旧的 listener，
+   已经建立的连接不属于任何 listener，会一直处理到结束，Shutdown() 也会等它们。新的 listener 打不开时返回错误，Server 保持原样。
+Shutdown() 开始之后就不能再 Reload 了，Reload() 会返回错误。
+Reload() 里的 Option 和 NewServer 里的一样按来源区分优先级，比如 Reload(FromFile(path)) 不会覆盖代码里设置过的字段。
+WatchConfig() 每隔 interval 检查一次配置文件的修改时间，变了就 Reload(FromFile(path))。
+配置文件里的 addr 和 port 能覆盖 NewServer 的参数，所以改了它们就会按上面第 3 条换到新的地址上。
+*/
+
+func (s *Server) Reload(opts ...Option) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping || (s.ctx != nil && s.ctx.Err() != nil) {
+		return errors.New("server: shutting down")
+	}
+	next, err := s.cloneConfig().apply(opts...)
+	if err != nil {
+		return err
+	}
+	if next.TLS != nil && isPacketProtocol(next.Protocol) {
+		return fmt.Errorf("server: TLS is not supported over %s", next.Protocol)
+	}
+
+	if s.cancel != nil && (next.Protocol != s.Protocol || next.address() != s.address()) {
+		oldListener, oldPacket := s.listener, s.packet
+		if err := s.listen(s.ctx, next); err != nil {
+			return err
+		}
+		if oldListener != nil {
+			oldListener.Close()
+		}
+		if oldPacket != nil {
+			oldPacket.Close()
+		}
+	}
+	if s.limiter != nil {
+		s.limiter.resize(next.MaxConns)
+	}
+	s.Addr, s.Port, s.Protocol = next.Addr, next.Port, next.Protocol
+	s.Timeout, s.MaxConns, s.TLS, s.Handler = next.Timeout, next.MaxConns, next.TLS, next.Handler
+	s.MaxConnsPerIP, s.AcceptRate, s.AcceptBurst, s.ReapIdle = next.MaxConnsPerIP, next.AcceptRate, next.AcceptBurst, next.ReapIdle
+	s.origins = next.origins
+	return nil
+}
+
+// cloneConfig 复制配置和字段来源，不复制运行状态，调用时要持有 s.mu 或者 s 不会再被修改
+func (s *Server) cloneConfig() *Server {
+	next := &Server{
+		Addr:     s.Addr,
+		Port:     s.Port,
+		Protocol: s.Protocol,
+		Timeout:  s.Timeout,
+		MaxConns: s.MaxConns,
+		TLS:      s.TLS,
+		Handler:  s.Handler,
+
+		MaxConnsPerIP: s.MaxConnsPerIP,
+		AcceptRate:    s.AcceptRate,
+		AcceptBurst:   s.AcceptBurst,
+		ReapIdle:      s.ReapIdle,
+
+		origins: map[string]fieldOrigin{},
+	}
+	for field, origin := range s.origins {
+		next.origins[field] = origin
+	}
+	return next
+}
+
+// apply 在 s 上应用 opts 并检查结果，s 必须是 cloneConfig() 出来的副本
+func (s *Server) apply(opts ...Option) (*Server, error) {
+	s.applying = SourceCode
+	errs := fieldErrors(options.Apply(s, nil, opts...))
+	errs = append(errs, s.validate()...)
+	if len(errs) > 0 {
+		return nil, &ValidationError{errs}
+	}
+	return s, nil
+}
+
+// WatchConfig 一直运行到 ctx 被取消，Reload 失败只打日志，继续使用原来的配置
+func (s *Server) WatchConfig(ctx context.Context, path string, interval time.Duration) error {
+	var last time.Time
+	if fi, err := os.Stat(path); err == nil {
+		last = fi.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Println("server: watch config:", err)
+			continue
+		}
+		if !fi.ModTime().After(last) {
+			continue
+		}
+		last = fi.ModTime()
+		if err := s.Reload(FromFile(path)); err != nil {
+			log.Println("server: reload config:", err)
+		}
+	}
+}
+
+/*********************************************** 8 */
+/**
+TLS 的几个辅助 Option，不用每次都手写 tls.Config：
+1. TLSFromFiles(cert, key)：从磁盘加载证书和私钥，握手时检查文件的修改时间，证书轮换之后新的握手自动用上新证书，
+   为了不让每次握手都去 stat 文件，最多每 certCheckInterval 检查一次；
+2. MutualTLS(caPool)：要求客户端也出示证书，并用 caPool 验证，也就是 mTLS；
+3. SelfSignedTLS(hosts...)：在内存里生成一个自签名证书，只适合本地开发。
+这几个 Option 都是在已有的 TLS 配置上修改（没有就新建一个），所以可以互相组合，写的顺序也无所谓；
+而 TLS(config) 会整个替换掉原来的配置。
+*/
+
+func tlsConfigOf(s *Server) *tls.Config {
+	if s.TLS == nil {
+		return &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return s.TLS.Clone()
+}
+
+// certCheckInterval 是两次检查证书文件修改时间之间的最短间隔，握手再频繁也最多这么久 stat 一次
+var certCheckInterval = time.Second
+
+// certReloader 在证书文件被修改之后重新加载证书
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	checked  time.Time // 上一次检查修改时间的时间
+}
+
+func (r *certReloader) stat() ([2]time.Time, error) {
+	var times [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return times, err
+		}
+		times[i] = fi.ModTime()
+	}
+	return times, nil
+}
+
+func (r *certReloader) load() error {
+	times, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTimes = &cert, times
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	if times, err := r.stat(); err == nil && times != r.modTimes {
+		// 轮换时证书和私钥可能还没都写完，加载失败就先继续用旧的证书
+		if err := r.load(); err != nil {
+			log.Println("server: reload certificate:", err)
+		}
+	}
+	return r.cert, nil
+}
+
+func TLSFromFiles(certFile, keyFile string) Option {
+	return Named(fmt.Sprintf("TLSFromFiles(%q, %q)", certFile, keyFile), func(s *Server) error {
+		r := &certReloader{certFile: certFile, keyFile: keyFile}
+		if err := r.load(); err != nil {
+			return &FieldError{"TLS", certFile, err.Error()}
+		}
+		conf := tlsConfigOf(s)
+		conf.Certificates = nil
+		conf.GetCertificate = r.GetCertificate
+		s.set("TLS", func() { s.TLS = conf })
+		return nil
+	}).Exclusive("certificate")
+}
+
+func MutualTLS(caPool *x509.CertPool) Option {
+	return Named("MutualTLS(...)", func(s *Server) error {
+		if caPool == nil {
+			return &FieldError{"TLS", caPool, "client CA pool must not be nil"}
+		}
+		conf := tlsConfigOf(s)
+		conf.ClientCAs = caPool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+		s.set("TLS", func() { s.TLS = conf })
+		return nil
+	})
+}
+
+func SelfSignedTLS(hosts ...string) Option {
+	return Named(fmt.Sprintf("SelfSignedTLS(%q)", hosts), func(s *Server) error {
+		cert, err := selfSignedCert(hosts...)
+		if err != nil {
+			return &FieldError{"TLS", hosts, err.Error()}
+		}
+		conf := tlsConfigOf(s)
+		conf.GetCertificate = nil
+		conf.Certificates = []tls.Certificate{cert}
+		s.set("TLS", func() { s.TLS = conf })
+		return nil
+	}).Exclusive("certificate")
+}
+
+// selfSignedCert 生成一个有效期一年的自签名证书，hosts 为空时默认是 localhost。
+// 证书同时可以用作服务端证书、客户端证书和验证它自己的 CA。
+func selfSignedCert(hosts ...string) (tls.Certificate, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// writeCertFiles 把证书和私钥写成 PEM 文件，先写临时文件再 rename，避免读到写了一半的文件
+func writeCertFiles(cert tls.Certificate, certFile, keyFile string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		path  string
+		block *pem.Block
+	}{
+		{keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}},
+		{certFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}},
+	}
+	for _, f := range files {
+		tmp := f.path + ".tmp"
+		if err := os.WriteFile(tmp, pem.EncodeToMemory(f.block), 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*********************************************** 9 */
+/**
+配置自省
+
+每个 Option 都有一个名字，比如 Timeout(5s)、FromEnv("APP")，字段被设置的时候会记下来源和 Option 的名字，
+嵌套的 Option 以最外层的名字为准，所以 FromEnv 里面设置的字段记的是 FromEnv("APP") 而不是 Timeout(20s)。
+自己写的 Option 用 Named() 来创建就会记下名字，直接用 options.New() 创建的只记来源，没有名字。
+
+Describe() 把最终生效的配置输出成 JSON，每个字段都带上值、来源和设置它的 Option，没有被设置过的字段来源就是 default。
+TLS 只输出证书的主题、有效期这些公开信息，私钥永远显示成 [REDACTED]。ConfigHandler() 用来挂在 /debug/config 上。
+*/
+
+func Named(name string, apply func(*Server) error) Option {
+	return options.New(name, func(s *Server) error {
+		if s.applyingName != "" {
+			return apply(s)
+		}
+		s.applyingName = name
+		defer func() { s.applyingName = "" }()
+		return apply(s)
+	})
+}
+
+type describedField struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+	Option string      `json:"option,omitempty"`
+}
+
+type describedCert struct {
+	Subject    string    `json:"subject"`
+	DNSNames   []string  `json:"dns_names,omitempty"`
+	IPs        []string  `json:"ips,omitempty"`
+	NotAfter   time.Time `json:"not_after"`
+	PrivateKey string    `json:"private_key"`
+}
+
+type describedTLS struct {
+	MinVersion   string          `json:"min_version"`
+	ClientAuth   string          `json:"client_auth"`
+	ClientCAs    bool            `json:"client_cas"`
+	Certificates []describedCert `json:"certificates,omitempty"`
+	Dynamic      bool            `json:"dynamic_certificate"`
+}
+
+var tlsVersions = map[uint16]string{
+	0:                "default",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func describeTLS(conf *tls.Config) interface{} {
+	if conf == nil {
+		return nil
+	}
+	d := describedTLS{
+		MinVersion: tlsVersions[conf.MinVersion],
+		ClientAuth: conf.ClientAuth.String(),
+		ClientCAs:  conf.ClientCAs != nil,
+		Dynamic:    conf.GetCertificate != nil,
+	}
+	for _, cert := range conf.Certificates {
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) > 0 {
+			leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		dc := describedCert{PrivateKey: "[REDACTED]"}
+		if leaf != nil {
+			dc.Subject, dc.DNSNames, dc.NotAfter = leaf.Subject.String(), leaf.DNSNames, leaf.NotAfter
+			for _, ip := range leaf.IPAddresses {
+				dc.IPs = append(dc.IPs, ip.String())
+			}
+		}
+		d.Certificates = append(d.Certificates, dc)
+	}
+	return d
+}
+
+func (s *Server) Describe() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var handler interface{}
+	if s.Handler != nil {
+		handler = fmt.Sprintf("%T", s.Handler)
+	}
+	values := map[string]interface{}{
+		"Addr":     s.Addr,
+		"Port":     s.Port,
+		"Protocol": s.Protocol,
+		"Timeout":  s.Timeout.String(),
+		"MaxConns": s.MaxConns,
+		"TLS":      describeTLS(s.TLS),
+		"Handler":  handler,
+
+		"MaxConnsPerIP": s.MaxConnsPerIP,
+		"AcceptRate":    map[string]interface{}{"per_second": s.AcceptRate, "burst": s.AcceptBurst},
+		"ReapIdle":      s.ReapIdle,
+	}
+	fields := map[string]describedField{}
+	for _, field := range serverFields {
+		origin := s.origins[field]
+		fields[field] = describedField{values[field], origin.Source.String(), origin.Option}
+	}
+	data, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return fmt.Sprintf(`{"error": %q}`, err.Error())
+	}
+	return string(data)
+}
+
+func (s *Server) ConfigHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, s.Describe())
+	}
+}
+
+/*********************************************** 10 */
+/**
+通用的 Functional Options
+
+Option 不再是手写的 func(*Server) error，而是 options 包里的 options.Option[Server]，任何结构体都可以这样用：
+	options.Apply(&target, defaults, opts...)
+NewServer 就是用 options.Apply 实现的。除了上面的那些，还可以：
+1. 用 options.Group 把几个 Option 组合成一个预设，比如 LocalDev()；
+2. 设置证书的 TLS、TLSFromFiles 和 SelfSignedTLS 是互斥的，同时用两个会在 NewServer 里直接报错，
+   而不是后面的悄悄覆盖前面的。
+*/
+
+// LocalDev 本地开发用的预设：只监听 127.0.0.1，用自签名证书，超时时间长一点方便调试
+func LocalDev() Option {
+	return options.Group("LocalDev",
+		listenAddr("127.0.0.1"),
+		SelfSignedTLS("localhost", "127.0.0.1"),
+		Timeout(5*time.Minute),
+	)
+}
+
+/*********************************************** 11 */
+/**
+Builder 和不可变的 Server
+
+第 3 部分的 Builder 模式现在有了正式的版本：ServerBuilder 的每个方法只是记下一个 Option，Build() 的时候交给 NewServer，
+所以校验、默认值和来源记录和 Functional Options 完全一样。
+
+Build() 得到的是 FrozenServer，一个冻结的配置快照：字段都是私有的，只能通过方法读取，TLS() 返回的也是一份拷贝，
+创建之后就再也不会被修改，所以可以随便在多个 Go Routine 之间共享。
+With(opts...) 在一份拷贝上应用新的 Option，得到一个新的 FrozenServer，原来的那个不受影响。
+要真正运行时，用 Server() 得到一个新的、还没启动的 *Server。
+*/
+
+type ServerBuilder struct {
+	addr string
+	port int
+	opts []Option
+}
+
+func NewServerBuilder(addr string, port int) *ServerBuilder {
+	return &ServerBuilder{addr: addr, port: port}
+}
+
+func (b *ServerBuilder) Protocol(p string) *ServerBuilder {
+	return b.With(Protocol(p))
+}
+
+func (b *ServerBuilder) Timeout(timeout time.Duration) *ServerBuilder {
+	return b.With(Timeout(timeout))
+}
+
+func (b *ServerBuilder) MaxConns(maxconns int) *ServerBuilder {
+	return b.With(MaxConns(maxconns))
+}
+
+func (b *ServerBuilder) TLS(tls *tls.Config) *ServerBuilder {
+	return b.With(TLS(tls))
+}
+
+func (b *ServerBuilder) Handler(h ConnHandler) *ServerBuilder {
+	return b.With(Handler(h))
+}
+
+func (b *ServerBuilder) MaxConnsPerIP(n int) *ServerBuilder {
+	return b.With(MaxConnsPerIP(n))
+}
+
+func (b *ServerBuilder) AcceptRate(perSecond float64, burst int) *ServerBuilder {
+	return b.With(AcceptRate(perSecond, burst))
+}
+
+func (b *ServerBuilder) ReapIdle(enabled bool) *ServerBuilder {
+	return b.With(ReapIdle(enabled))
+}
+
+// With 添加任意的 Option，比如 FromEnv 或者 LocalDev()
+func (b *ServerBuilder) With(opts ...Option) *ServerBuilder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+func (b *ServerBuilder) Build() (*FrozenServer, error) {
+	srv, err := NewServer(b.addr, b.port, b.opts...)
+	if err != nil {
+		return nil, err
+	}
+	return freeze(srv), nil
+}
+
+type FrozenServer struct {
+	srv *Server
+}
+
+// freeze 复制 s 的配置，TLS 也复制一份，之后谁也改不到快照里的内容
+func freeze(s *Server) *FrozenServer {
+	conf := s.cloneConfig()
+	if conf.TLS != nil {
+		conf.TLS = conf.TLS.Clone()
+	}
+	return &FrozenServer{conf}
+}
+
+// Freeze 返回 s 当前配置的快照
+func (s *Server) Freeze() *FrozenServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return freeze(s)
+}
+
+func (f *FrozenServer) Addr() string           { return f.srv.Addr }
+func (f *FrozenServer) Port() int              { return f.srv.Port }
+func (f *FrozenServer) Protocol() string       { return f.srv.Protocol }
+func (f *FrozenServer) Timeout() time.Duration { return f.srv.Timeout }
+func (f *FrozenServer) MaxConns() int          { return f.srv.MaxConns }
+func (f *FrozenServer) Handler() ConnHandler   { return f.srv.Handler }
+func (f *FrozenServer) MaxConnsPerIP() int     { return f.srv.MaxConnsPerIP }
+func (f *FrozenServer) ReapIdle() bool         { return f.srv.ReapIdle }
+
+func (f *FrozenServer) AcceptRate() (perSecond float64, burst int) {
+	return f.srv.AcceptRate, f.srv.AcceptBurst
+}
+
+func (f *FrozenServer) TLS() *tls.Config {
+	if f.srv.TLS == nil {
+		return nil
+	}
+	return f.srv.TLS.Clone()
+}
+
+func (f *FrozenServer) Describe() string {
+	return f.srv.Describe()
+}
+
+func (f *FrozenServer) With(opts ...Option) (*FrozenServer, error) {
+	next, err := f.Server().apply(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return freeze(next), nil
+}
+
+// Server 返回一个按这份快照配置的、还没启动的 *Server
+func (f *FrozenServer) Server() *Server {
+	return freeze(f.srv).srv
+}
+
+/*********************************************** 12 */
+/**
+按客户端限流
+
+MaxConns 限制的是整个 Server 的连接数，一个客户端就能把名额占满。下面这几个 Option 按客户端的 IP 来限制：
+1. MaxConnsPerIP(n)：同一个 IP 最多同时有 n 个连接，多出来的连接 Accept 之后马上关闭；
+2. AcceptRate(perSecond, burst)：每个 IP 一个令牌桶，每秒补充 perSecond 个令牌，最多攒 burst 个，没有令牌的新连接也是马上关闭；
+3. ReapIdle(true)：定期检查所有连接，超过 Timeout 没有读写的就关掉，
+   deadline 只能打断正在进行的读写，拿着连接却一直不读不写的 Handler 要靠它来清理。检查的间隔是 Timeout/2。
+udp 没有连接，这两个限制作用在每个数据包上，超过限制的数据包直接丢弃；unix socket 的所有连接算作同一个客户端。
+这些字段和其它字段一样可以 Reload，新的限制从下一个连接开始生效。
+MaxConnsPerIP(0) 和 AcceptRate(0, 0) 表示不限制，和字段的零值一样，Reload 的时候用它们去掉已经设置的限制。
+
+Clients() 返回每个客户端的计数，Throttled() 为 true 的就是被限制过的客户端，ClientsHandler() 用来挂在 /debug/clients 上。
+公网上的客户端 IP 是数不完的，所以一个客户端没有连接、令牌桶也补满了之后就会被清理掉，只有被限制过的客户端的计数会保留下来，
+最多保留 maxRetainedClients 个，再多的都累加到 otherClients 这一项里。
+*/
+
+const (
+	maxRetainedClients = 1024
+	otherClients       = "other"
+)
+
+func MaxConnsPerIP(n int) Option {
+	return Named(fmt.Sprintf("MaxConnsPerIP(%d)", n), func(s *Server) error {
+		if n < 0 {
+			return &FieldError{"MaxConnsPerIP", n, "must not be negative"}
+		}
+		s.set("MaxConnsPerIP", func() { s.MaxConnsPerIP = n })
+		return nil
+	})
+}
+
+func AcceptRate(perSecond float64, burst int) Option {
+	return Named(fmt.Sprintf("AcceptRate(%g, %d)", perSecond, burst), func(s *Server) error {
+		if perSecond < 0 {
+			return &FieldError{"AcceptRate", perSecond, "must not be negative"}
+		}
+		if perSecond > 0 && burst < 1 {
+			return &FieldError{"AcceptBurst", burst, "must be at least 1"}
+		}
+		s.set("AcceptRate", func() { s.AcceptRate, s.AcceptBurst = perSecond, burst })
+		return nil
+	})
+}
+
+func ReapIdle(enabled bool) Option {
+	return Named(fmt.Sprintf("ReapIdle(%t)", enabled), func(s *Server) error {
+		s.set("ReapIdle", func() { s.ReapIdle = enabled })
+		return nil
+	})
+}
+
+type ClientStats struct {
+	Active      int    `json:"active"`
+	Accepted    uint64 `json:"accepted"`
+	OverLimit   uint64 `json:"over_limit"`   // 超过 MaxConnsPerIP 被拒绝的次数
+	RateLimited uint64 `json:"rate_limited"` // 超过 AcceptRate 被拒绝的次数
+	Reaped      uint64 `json:"reaped"`       // 空闲超过 Timeout 被关闭的次数
+}
+
+func (c ClientStats) Throttled() bool {
+	return c.OverLimit > 0 || c.RateLimited > 0
+}
+
+func (c ClientStats) add(o ClientStats) ClientStats {
+	return ClientStats{
+		Active:      c.Active + o.Active,
+		Accepted:    c.Accepted + o.Accepted,
+		OverLimit:   c.OverLimit + o.OverLimit,
+		RateLimited: c.RateLimited + o.RateLimited,
+		Reaped:      c.Reaped + o.Reaped,
+	}
+}
+
+type clientState struct {
+	ClientStats
+	tokens float64
+	last   time.Time
+}
+
+// clientKey 是限流时区分客户端用的 key，一般就是对方的 IP
+func clientKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// admit 决定是否接受 client 的一个新连接，接受之后要调用 leave
+func (s *Server) admit(client string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clients[client]
+	if c == nil {
+		c = &clientState{}
+		s.clients[client] = c
+	}
+	if s.MaxConnsPerIP > 0 && c.Active >= s.MaxConnsPerIP {
+		c.OverLimit++
+		return false
+	}
+	if s.AcceptRate > 0 {
+		// 第一次见到的客户端 last 是零值，桶直接是满的
+		now := time.Now()
+		c.tokens = math.Min(float64(s.AcceptBurst), c.tokens+now.Sub(c.last).Seconds()*s.AcceptRate)
+		c.last = now
+		if c.tokens < 1 {
+			c.RateLimited++
+			return false
+		}
+		c.tokens--
+	}
+	c.Active++
+	c.Accepted++
+	return true
+}
+
+func (s *Server) leave(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[client].Active--
+	s.prune(client, time.Now())
+}
+
+// prune 在 client 没有连接、令牌桶也已经补满的时候把它清理掉，调用时要持有 s.mu
+func (s *Server) prune(client string, now time.Time) {
+	c := s.clients[client]
+	if c.Active > 0 {
+		return
+	}
+	if s.AcceptRate > 0 && c.tokens+now.Sub(c.last).Seconds()*s.AcceptRate < float64(s.AcceptBurst) {
+		return
+	}
+	delete(s.clients, client)
+	if !c.Throttled() {
+		return
+	}
+	if _, ok := s.retained[client]; !ok && len(s.retained) >= maxRetainedClients {
+		client = otherClients
+	}
+	s.retained[client] = s.retained[client].add(c.ClientStats)
+}
+
+// reapIdle 一直运行到 ctx 被取消，Timeout 和 ReapIdle 都可能被 Reload 修改，所以每一轮都重新读
+func (s *Server) reapIdle(ctx context.Context) {
+	for {
+		timer := time.NewTimer(s.currentTimeout() / 2)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		s.mu.Lock()
+		if s.ReapIdle {
+			for conn, client := range s.conns {
+				if !conn.reaped && conn.idle() > s.Timeout {
+					conn.reaped = true
+					conn.Close()
+					s.clients[client].Reaped++
+				}
+			}
+		}
+		// 令牌桶在没有新连接的时候才慢慢补满，这种客户端只能在这里清理
+		now := time.Now()
+		for client := range s.clients {
+			s.prune(client, now)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Clients 返回每个客户端的计数，Server 还没有启动时返回空的 map
+func (s *Server) Clients() map[string]ClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]ClientStats, len(s.clients)+len(s.retained))
+	for client, c := range s.retained {
+		stats[client] = c
+	}
+	for client, c := range s.clients {
+		stats[client] = stats[client].add(c.ClientStats)
+	}
+	return stats
+}
+
+func (s *Server) ClientsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Clients())
+	}
+}
+
 func main() {
 	/**
 	直觉式的编程；
@@ -190,4 +1742,250 @@ func main() {
 	s2, _ := NewServer("localhost", 2048, Protocol("udp"))
 	s3, _ := NewServer("0.0.0.0", 8080, Timeout(300*time.Second), MaxConns(1000))
 	println(s1, s2, s3)
+
+	/**
+	所有写错的字段一次性报出来
+	*/
+	_, err := NewServer("", 70000, Protocol("quic"), Timeout(0), MaxConns(-1))
+	fmt.Println(err)
+
+	/**
+	配置文件里的 addr 和 port 覆盖了 NewServer 的参数，timeout 被环境变量覆盖，环境变量里的 max_conns 又被命令行参数覆盖，
+	代码里的 Protocol 优先级最高，不管它写在哪个位置
+	*/
+	conf := filepath.Join(os.TempDir(), "case_functional.toml")
+	os.WriteFile(conf, []byte("addr = \"0.0.0.0\"\nport = 9000\nprotocol = \"tcp\"\ntimeout = \"10s\"\nmax_conns = 100\n"), 0644)
+	os.Setenv("APP_TIMEOUT", "20s")
+	os.Setenv("APP_MAX_CONNS", "200")
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	fromFlags := FromFlags(fs)
+	fs.Parse([]string{"-max-conns", "300"})
+	s4, err := NewServer("localhost", 8080, Protocol("udp"), fromFlags, FromEnv("APP"), FromFile(conf))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(s4.Addr, s4.Port, s4.Protocol, s4.Timeout, s4.MaxConns)
+	origins := s4.Origins()
+	for _, field := range serverFields {
+		fmt.Printf("  %s from %s\n", field, origins[field])
+	}
+
+	/**
+	预设和互斥的 Option
+	*/
+	dev, err := NewServer("0.0.0.0", 8443, LocalDev(), MaxConns(10))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("LocalDev:", dev.Addr, dev.Timeout, dev.MaxConns, dev.TLS != nil)
+	_, err = NewServer("0.0.0.0", 8443, LocalDev(), TLSFromFiles("server.pem", "server.key"))
+	fmt.Println(err)
+
+	/**
+	Builder 得到冻结的快照，With 派生出新的快照，原来的不变；多个 Go Routine 同时读写同一个快照也没有问题
+	*/
+	base, err := NewServerBuilder("0.0.0.0", 8080).Protocol("tcp").Timeout(10 * time.Second).MaxConns(100).Build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	derived := make([]*FrozenServer, 4)
+	for i := range derived {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			derived[i], _ = base.With(MaxConns(base.MaxConns() * (i + 2)))
+		}(i)
+	}
+	wg.Wait()
+	fmt.Println("base:", base.Protocol(), base.Timeout(), base.MaxConns())
+	for _, d := range derived {
+		fmt.Println("derived:", d.Protocol(), d.Timeout(), d.MaxConns())
+	}
+
+	/**
+	启动一个 echo 服务，tcp 和 udp 各发一次数据，然后优雅地关闭
+	*/
+	echo := ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	ctx := context.Background()
+	for _, protocol := range []string{"tcp", "udp"} {
+		srv, err := NewServer("127.0.0.1", 0, Protocol(protocol), Timeout(time.Second), MaxConns(10), Handler(echo))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := srv.Start(ctx); err != nil {
+			log.Fatal(err)
+		}
+		conn, err := net.Dial(protocol, srv.ListenAddr().String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s echo: %s\n", srv.ListenAddr(), roundTrip(conn, "hello "+protocol))
+		conn.Close()
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+		fmt.Println("shutdown:", srv.Shutdown(shutdownCtx))
+		cancel()
+	}
+
+	/**
+	热加载：先建立一个连接，然后把 Server 换到一个 unix socket 上，
+	旧的连接还能继续用，新的连接要连到新的地址上
+	*/
+	srv, err := NewServer("127.0.0.1", 0, Timeout(time.Second), Handler(echo))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	oldAddr := srv.ListenAddr().String()
+	inFlight, err := net.Dial("tcp", oldAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("before reload:", roundTrip(inFlight, "ping"))
+
+	sock := filepath.Join(os.TempDir(), "case_functional.sock")
+	os.Remove(sock)
+	if err := srv.Reload(Protocol("unix"), listenAddr(sock), Timeout(5*time.Second), MaxConns(50)); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("after reload, in-flight:", roundTrip(inFlight, "still here"), srv.Timeout, srv.MaxConns)
+	if _, err := net.Dial("tcp", oldAddr); err != nil {
+		fmt.Println("old address closed")
+	}
+	fresh, err := net.Dial("unix", sock)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("new listener:", srv.ListenAddr(), roundTrip(fresh, "hello unix"))
+	fresh.Close()
+	inFlight.Close()
+	fmt.Println("reload with bad config:", srv.Reload(MaxConns(0)) != nil)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+	fmt.Println("shutdown:", srv.Shutdown(shutdownCtx))
+	cancel()
+
+	/**
+	按客户端限流：同一个 IP 最多 2 个连接，第 3 个马上被关闭；
+	hold 回一次消息之后就不再读写，ReapIdle 会在 Timeout 之后替它关掉连接，不用等到 Handler 返回；
+	令牌桶一开始有 3 个令牌，前面用掉了 2 个，接下来连续的 3 个连接只有第一个能进来
+	*/
+	hold := ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		conn.Write(buf[:n])
+		select {
+		case <-ctx.Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	})
+	limited, err := NewServer("127.0.0.1", 0, Timeout(200*time.Millisecond), Handler(hold),
+		MaxConnsPerIP(2), AcceptRate(1, 3), ReapIdle(true))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := limited.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	dialLimited := func() net.Conn {
+		conn, err := net.Dial("tcp", limited.ListenAddr().String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return conn
+	}
+	var held []net.Conn
+	for i := 0; i < 3; i++ {
+		conn := dialLimited()
+		fmt.Printf("conn %d: %q\n", i, roundTrip(conn, "hi"))
+		held = append(held, conn)
+	}
+	start := time.Now()
+	n, _ := held[0].Read(make([]byte, 1))
+	fmt.Println("idle conn reaped before handler returned:", n == 0 && time.Since(start) < 500*time.Millisecond)
+	for _, conn := range held {
+		conn.Close()
+	}
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		conn := dialLimited()
+		fmt.Printf("burst conn %d: %q\n", i, roundTrip(conn, "hi"))
+		conn.Close()
+	}
+	for client, stats := range limited.Clients() {
+		fmt.Printf("%s: %+v throttled=%t\n", client, stats, stats.Throttled())
+	}
+	shutdownCtx, cancel = context.WithTimeout(ctx, time.Second)
+	fmt.Println("shutdown:", limited.Shutdown(shutdownCtx))
+	cancel()
+
+	/**
+	mTLS：服务端证书从文件加载，只接受 clientCert 签发的客户端证书；
+	服务端证书文件轮换之后，最多过 certCheckInterval，新的连接看到的就是新证书的序列号
+	*/
+	dir, err := os.MkdirTemp("", "case_functional_tls")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	serverCert, _ := selfSignedCert("127.0.0.1")
+	clientCert, _ := selfSignedCert("client")
+	if err := writeCertFiles(serverCert, certFile, keyFile); err != nil {
+		log.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+	tlsSrv, err := NewServer("127.0.0.1", 0, Handler(echo), TLSFromFiles(certFile, keyFile), MutualTLS(clientCAs))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := tlsSrv.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	tlsDial := func(server tls.Certificate) {
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Leaf)
+		conf := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}
+		conn, err := tls.Dial("tcp", tlsSrv.ListenAddr().String(), conf)
+		if err != nil {
+			fmt.Println("tls dial:", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Printf("mtls echo: %s, server serial %x\n", roundTrip(conn, "secret"), conn.ConnectionState().PeerCertificates[0].SerialNumber)
+	}
+	tlsDial(serverCert)
+	rotated, _ := selfSignedCert("127.0.0.1")
+	if err := writeCertFiles(rotated, certFile, keyFile); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("rotated to serial %x\n", rotated.Leaf.SerialNumber)
+	time.Sleep(certCheckInterval)
+	tlsDial(rotated)
+
+	/**
+	启动日志里打印生效的配置，同时挂到 /debug/config 上，私钥不会出现在输出里
+	*/
+	mux := http.NewServeMux()
+	mux.Handle("/debug/config", tlsSrv.ConfigHandler())
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/config", nil))
+	fmt.Println(rec.Code, rec.Body.String())
+
+	shutdownCtx, cancel = context.WithTimeout(ctx, time.Second)
+	fmt.Println("shutdown:", tlsSrv.Shutdown(shutdownCtx))
+	cancel()
+}
+
+func roundTrip(conn net.Conn, msg string) string {
+	conn.Write([]byte(msg))
+	reply := make([]byte, 64)
+	n, _ := conn.Read(reply)
+	return string(reply[:n])
 }
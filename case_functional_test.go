@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewServerRecordsAddrAndPortAsArguments(t *testing.T) {
+	srv, err := NewServer("localhost", 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := srv.Origins()
+	if origins["Addr"] != SourceArgument || origins["Port"] != SourceArgument || origins["Timeout"] != SourceDefault {
+		t.Fatalf("origins = %v", origins)
+	}
+	var fields map[string]describedField
+	if err := json.Unmarshal([]byte(srv.Describe()), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if f := fields["Addr"]; f.Source != "argument" || f.Option != `NewServer("localhost", 8080)` {
+		t.Fatalf("Addr = %+v", f)
+	}
+}
+
+func TestSourcePrecedence(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "server.yaml")
+	data := "addr: 0.0.0.0\nport: 9000\nprotocol: tcp\ntimeout: 10s\nmax_conns: 100\n"
+	if err := os.WriteFile(conf, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PRECEDENCE_PORT", "9001")
+	t.Setenv("PRECEDENCE_TIMEOUT", "20s")
+	t.Setenv("PRECEDENCE_MAX_CONNS", "200")
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fromFlags := FromFlags(fs)
+	if err := fs.Parse([]string{"-timeout", "40s", "-max-conns", "300"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写的顺序和优先级相反，结果只看来源
+	srv, err := NewServer("localhost", 8080, MaxConns(400), fromFlags, FromEnv("PRECEDENCE"), FromFile(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct {
+		value  interface{}
+		source Source
+	}{
+		"Addr":     {"0.0.0.0", SourceFile},
+		"Port":     {9001, SourceEnv},
+		"Protocol": {"tcp", SourceFile},
+		"Timeout":  {40 * time.Second, SourceFlag},
+		"MaxConns": {400, SourceCode},
+		"ReapIdle": {false, SourceDefault},
+	}
+	got := map[string]interface{}{
+		"Addr": srv.Addr, "Port": srv.Port, "Protocol": srv.Protocol,
+		"Timeout": srv.Timeout, "MaxConns": srv.MaxConns, "ReapIdle": srv.ReapIdle,
+	}
+	origins := srv.Origins()
+	for field, w := range want {
+		if got[field] != w.value || origins[field] != w.source {
+			t.Errorf("%s = %v from %s, want %v from %s", field, got[field], origins[field], w.value, w.source)
+		}
+	}
+}
+
+// freePort 找一个当前没有被占用的端口，用来测试固定端口上的行为
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func echoHandler() ConnHandler {
+	return ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+}
+
+func TestReloadTLSOnFixedPort(t *testing.T) {
+	srv, err := NewServer("127.0.0.1", freePort(t), Timeout(time.Second), Handler(echoHandler()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	addr := srv.ListenAddr().String()
+
+	cert, err := selfSignedCert("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Reload(TLS(&tls.Config{Certificates: []tls.Certificate{cert}})); err != nil {
+		t.Fatalf("Reload(TLS(...)): %v", err)
+	}
+	if got := srv.ListenAddr().String(); got != addr {
+		t.Fatalf("listener moved from %s to %s", addr, got)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := roundTrip(conn, "secret"); got != "secret" {
+		t.Fatalf("tls echo = %q", got)
+	}
+
+	// 已经建立的连接用的还是原来的证书，新的连接用新的证书
+	if err := srv.Reload(SelfSignedTLS("127.0.0.1")); err != nil {
+		t.Fatalf("Reload(SelfSignedTLS(...)): %v", err)
+	}
+	if got := roundTrip(conn, "still here"); got != "still here" {
+		t.Fatalf("in-flight echo after reload = %q", got)
+	}
+	rotated := srv.Freeze().TLS().Certificates[0]
+	roots = x509.NewCertPool()
+	roots.AddCert(rotated.Leaf)
+	fresh, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh.Close()
+
+	if err := srv.Reload(TLS(nil)); err != nil {
+		t.Fatalf("Reload(TLS(nil)): %v", err)
+	}
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if got := roundTrip(plain, "plain"); got != "plain" {
+		t.Fatalf("plain echo after disabling TLS = %q", got)
+	}
+}
+
+func TestReloadAfterShutdown(t *testing.T) {
+	srv, err := NewServer("127.0.0.1", 0, Handler(echoHandler()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Reload(MaxConns(10)); err == nil {
+		t.Fatal("Reload after Shutdown returned nil")
+	}
+	if srv.ListenAddr() == nil {
+		return
+	}
+	if conn, err := net.Dial("tcp", srv.ListenAddr().String()); err == nil {
+		conn.Close()
+		t.Fatal("server is still accepting connections after Shutdown")
+	}
+}
+
+func TestCertReloaderThrottlesChecks(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	first, _ := selfSignedCert("127.0.0.1")
+	if err := writeCertFiles(first, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	serial := func() string {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.String()
+	}
+	serial()
+
+	// 文件被删掉了，但在 certCheckInterval 之内不会再去 stat，握手照样用内存里的证书
+	rotated, _ := selfSignedCert("127.0.0.1")
+	os.Remove(certFile)
+	if got := serial(); got != first.Leaf.SerialNumber.String() {
+		t.Fatalf("serial = %s, want the cached %s", got, first.Leaf.SerialNumber)
+	}
+	if err := writeCertFiles(rotated, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(); got != first.Leaf.SerialNumber.String() {
+		t.Fatalf("certificate reloaded before certCheckInterval elapsed")
+	}
+
+	r.mu.Lock()
+	r.checked = time.Now().Add(-certCheckInterval)
+	r.mu.Unlock()
+	if got := serial(); got != rotated.Leaf.SerialNumber.String() {
+		t.Fatalf("serial = %s, want the rotated %s", got, rotated.Leaf.SerialNumber)
+	}
+}
+
+func TestClientsArePrunedAndRetainedCountersAreBounded(t *testing.T) {
+	srv, err := NewServer("127.0.0.1", 0, Handler(echoHandler()), MaxConnsPerIP(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	if !srv.admit("a") || srv.admit("a") || !srv.admit("b") {
+		t.Fatal("MaxConnsPerIP(1) not enforced")
+	}
+	srv.leave("a")
+	srv.leave("b")
+	stats := srv.Clients()
+	if _, ok := stats["b"]; ok || len(srv.clients) != 0 {
+		t.Fatalf("idle clients not pruned: %v", stats)
+	}
+	if a := stats["a"]; a.OverLimit != 1 || a.Active != 0 {
+		t.Fatalf("throttled client a = %+v, want its counters retained", a)
+	}
+
+	for i := 0; i < maxRetainedClients+10; i++ {
+		client := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		srv.admit(client)
+		srv.admit(client)
+		srv.leave(client)
+	}
+	stats = srv.Clients()
+	if len(stats) != maxRetainedClients+1 || stats[otherClients].OverLimit != 11 {
+		t.Fatalf("got %d clients, other = %+v", len(stats), stats[otherClients])
+	}
+}
+
+func TestFrozenServerWithCopiesTLS(t *testing.T) {
+	base, err := NewServerBuilder("127.0.0.1", 0).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &tls.Config{MinVersion: tls.VersionTLS13}
+	derived, err := base.With(TLS(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.MinVersion = tls.VersionTLS10
+	if got := derived.TLS().MinVersion; got != tls.VersionTLS13 {
+		t.Fatalf("MinVersion = %#x after mutating the caller's config, want %#x", got, tls.VersionTLS13)
+	}
+	if base.TLS() != nil {
+		t.Fatal("With modified the original snapshot")
+	}
+}
+
+func TestWatchConfigMovesListener(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "server.json")
+	writeConf := func(port int, mtime time.Time) {
+		data := fmt.Sprintf(`{"addr": "127.0.0.1", "port": %d}`, port)
+		if err := os.WriteFile(conf, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(conf, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConf(freePort(t), time.Now())
+	srv, err := NewServer("localhost", 0, FromFile(conf), Handler(echoHandler()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	oldAddr := srv.ListenAddr().String()
+
+	conn, err := net.Dial("tcp", oldAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := roundTrip(conn, "before"); got != "before" {
+		t.Fatalf("echo = %q", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.WatchConfig(ctx, conf, 10*time.Millisecond)
+	newPort := freePort(t)
+	newAddr := net.JoinHostPort("127.0.0.1", fmt.Sprint(newPort))
+	// WatchConfig 可能在改文件之后才第一次 stat，所以每次都把修改时间再往后推一点，直到它发现为止
+	mtime := time.Now()
+	for deadline := mtime.Add(5 * time.Second); srv.ListenAddr().String() != newAddr; {
+		if time.Now().After(deadline) {
+			t.Fatalf("listener still on %s, want %s", srv.ListenAddr(), newAddr)
+		}
+		mtime = mtime.Add(time.Second)
+		writeConf(newPort, mtime)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if origin := srv.Origins()["Port"]; origin != SourceFile {
+		t.Fatalf("Port from %s, want file", origin)
+	}
+	if got := roundTrip(conn, "after"); got != "after" {
+		t.Fatalf("in-flight echo after handover = %q", got)
+	}
+	fresh, err := net.Dial("tcp", newAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if got := roundTrip(fresh, "new"); got != "new" {
+		t.Fatalf("echo on the new listener = %q", got)
+	}
+	if old, err := net.Dial("tcp", oldAddr); err == nil {
+		old.Close()
+		t.Fatalf("old listener %s is still accepting", oldAddr)
+	}
+}
+
+func TestReloadRemovesClientLimits(t *testing.T) {
+	srv, err := NewServer("127.0.0.1", 0, Handler(echoHandler()), MaxConnsPerIP(1), AcceptRate(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	if !srv.admit("a") || srv.admit("a") {
+		t.Fatal("limits not enforced")
+	}
+	if err := srv.Reload(MaxConnsPerIP(0), AcceptRate(0, 0)); err != nil {
+		t.Fatalf("Reload with zero limits: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if !srv.admit("a") {
+			t.Fatalf("connection %d rejected after removing the limits", i+2)
+		}
+	}
+	if _, err := NewServer("127.0.0.1", 0, MaxConnsPerIP(-1)); err == nil {
+		t.Fatal("MaxConnsPerIP(-1) accepted")
+	}
+	if _, err := NewServer("127.0.0.1", 0, AcceptRate(1, 0)); err == nil {
+		t.Fatal("AcceptRate(1, 0) accepted")
+	}
+}
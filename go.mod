@@ -2,4 +2,8 @@ module geekbang
 
 go 1.18
 
-require github.com/pkg/errors v0.9.1 // indirect
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/pkg/errors v0.9.1
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,18 @@
+// Package example 演示 optgen 的用法，server_options.go 是用 go generate 生成的。
+package example
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+//go:generate go run geekbang/optgen -type Server
+
+type Server struct {
+	Addr     string        `opt:"required"`
+	Port     int           `opt:"required"`
+	Protocol string        `opt:"default=tcp,required"`
+	Timeout  time.Duration `opt:"default=30s"`
+	MaxConns int           `opt:"default=1000"`
+	TLS      *tls.Config
+}
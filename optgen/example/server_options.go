@@ -0,0 +1,75 @@
+// Code generated by optgen -type Server; DO NOT EDIT.
+
+package example
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"geekbang/options"
+)
+
+type ServerOption = options.Option[Server]
+
+func WithAddr(v string) ServerOption {
+	return options.Set("WithAddr", func(x *Server) {
+		x.Addr = v
+	})
+}
+
+func WithPort(v int) ServerOption {
+	return options.Set("WithPort", func(x *Server) {
+		x.Port = v
+	})
+}
+
+func WithProtocol(v string) ServerOption {
+	return options.Set("WithProtocol", func(x *Server) {
+		x.Protocol = v
+	})
+}
+
+func WithTimeout(v time.Duration) ServerOption {
+	return options.Set("WithTimeout", func(x *Server) {
+		x.Timeout = v
+	})
+}
+
+func WithMaxConns(v int) ServerOption {
+	return options.Set("WithMaxConns", func(x *Server) {
+		x.MaxConns = v
+	})
+}
+
+func WithTLS(v *tls.Config) ServerOption {
+	return options.Set("WithTLS", func(x *Server) {
+		x.TLS = v
+	})
+}
+
+func NewServer(opts ...ServerOption) (*Server, error) {
+	x := &Server{}
+	if err := options.Apply(x, func(x *Server) {
+		x.Protocol = "tcp"
+		x.Timeout = 30 * time.Second
+		x.MaxConns = 1000
+	}, opts...); err != nil {
+		return nil, err
+	}
+	var missing []string
+	if x.Addr == "" {
+		missing = append(missing, "Addr")
+	}
+	if x.Port == 0 {
+		missing = append(missing, "Port")
+	}
+	if x.Protocol == "" {
+		missing = append(missing, "Protocol")
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Server: missing required field(s): %s", strings.Join(missing, ", "))
+	}
+	return x, nil
+}
@@ -0,0 +1,32 @@
+package example
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"geekbang/options"
+)
+
+func TestNewServer(t *testing.T) {
+	srv, err := NewServer(WithAddr("localhost"), WithPort(8080), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Protocol != "tcp" || srv.Timeout != time.Second || srv.MaxConns != 1000 {
+		t.Fatalf("got %+v", srv)
+	}
+
+	// 生成的 Option 就是 options.Option[Server]，可以组合成预设
+	local := options.Group("local", WithAddr("127.0.0.1"), WithPort(9000))
+	if srv, err := NewServer(local); err != nil || srv.Addr != "127.0.0.1" {
+		t.Fatalf("NewServer(local) = %+v, %v", srv, err)
+	}
+}
+
+func TestNewServerRequired(t *testing.T) {
+	_, err := NewServer(WithPort(8080), WithProtocol(""))
+	if err == nil || !strings.Contains(err.Error(), "Addr, Protocol") {
+		t.Fatalf("got %v, want Addr and Protocol reported as missing", err)
+	}
+}
@@ -0,0 +1,349 @@
+// optgen 根据结构体的 opt 标签生成 Functional Options 的代码，配合 go generate 使用：
+//
+//	//go:generate go run geekbang/optgen -type Server
+//
+// 生成的代码基于 geekbang/options 这个通用的 Functional Options 框架，对于 Server 会生成 server_options.go，里面有：
+//  1. type ServerOption = options.Option[Server]，所以生成的 Option 可以和手写的 Option、options.Group 预设混在一起用；
+//  2. 每个导出字段一个 WithXxx(v) ServerOption；
+//  3. NewServer(opts ...ServerOption) (*Server, error)，用 options.Apply 先设置默认值，再应用 opts，最后检查必填字段。
+//
+// 标签的写法：
+//
+//	Protocol string        `opt:"default=tcp"`           // 默认值，支持字符串、数字、bool 和 time.Duration
+//	Addr     string        `opt:"required"`              // 必填，应用完 opts 之后还是零值就报错
+//	Network  string        `opt:"default=tcp,required"`  // 有默认值，但不能被 opts 改成零值
+//	Secret   string        `opt:"-"`                     // 不生成 WithSecret
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type field struct {
+	Name      string
+	Type      string
+	Default   string // 已经转换成 Go 表达式的默认值，空表示没有默认值
+	Required  bool
+	Zero      string // 判断零值的表达式，%s 替换成字段
+	NeedsTime bool
+	Packages  []string
+}
+
+func main() {
+	typeName := flag.String("type", "", "struct type to generate options for (required)")
+	output := flag.String("output", "", "output file name; default <type>_options.go")
+	dir := flag.String("dir", ".", "directory of the package containing the type")
+	optionsPkg := flag.String("options", "geekbang/options", "import path of the options package")
+	flag.Parse()
+	if *typeName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output == "" {
+		*output = strings.ToLower(*typeName) + "_options.go"
+	}
+
+	src, err := generate(*dir, *typeName, *output, *optionsPkg)
+	if err != nil {
+		log.Fatalf("optgen: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(*dir, *output), src, 0644); err != nil {
+		log.Fatalf("optgen: %v", err)
+	}
+}
+
+func generate(dir, typeName, output, optionsPkg string) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return fi.Name() != output && !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			st := findStruct(file, typeName)
+			if st == nil {
+				continue
+			}
+			fields, err := parseFields(st)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", typeName, err)
+			}
+			return render(pkg.Name, typeName, fields, importsOf(file), optionsPkg)
+		}
+	}
+	return nil, fmt.Errorf("struct %s not found in %s", typeName, dir)
+}
+
+func findStruct(file *ast.File, name string) *ast.StructType {
+	var found *ast.StructType
+	ast.Inspect(file, func(n ast.Node) bool {
+		if ts, ok := n.(*ast.TypeSpec); ok && ts.Name.Name == name {
+			found, _ = ts.Type.(*ast.StructType)
+			return false
+		}
+		return found == nil
+	})
+	return found
+}
+
+// importsOf 返回文件里的 import，key 是包名，value 是 import 路径
+func importsOf(file *ast.File) map[string]string {
+	imports := map[string]string{}
+	for _, spec := range file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		name := filepath.Base(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = path
+	}
+	return imports
+}
+
+func parseFields(st *ast.StructType) ([]field, error) {
+	var fields []field
+	for _, f := range st.Fields.List {
+		var tag string
+		if f.Tag != nil {
+			raw, _ := strconv.Unquote(f.Tag.Value)
+			tag = reflect.StructTag(raw).Get("opt")
+		}
+		if tag == "-" {
+			continue
+		}
+		typ := exprString(f.Type)
+		for _, name := range f.Names {
+			if !name.IsExported() {
+				continue
+			}
+			fd := field{Name: name.Name, Type: typ, Packages: packagesOf(f.Type)}
+			if err := fd.parseTag(tag); err != nil {
+				return nil, fmt.Errorf("field %s: %w", name.Name, err)
+			}
+			fd.Zero = zeroCheck(f.Type)
+			fields = append(fields, fd)
+		}
+	}
+	return fields, nil
+}
+
+func (fd *field) parseTag(tag string) error {
+	if tag == "" {
+		return nil
+	}
+	for _, part := range strings.Split(tag, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "required":
+			fd.Required = true
+		case strings.HasPrefix(part, "default="):
+			expr, needsTime, err := defaultExpr(fd.Type, strings.TrimPrefix(part, "default="))
+			if err != nil {
+				return err
+			}
+			fd.Default, fd.NeedsTime = expr, needsTime
+		default:
+			return fmt.Errorf("unknown opt tag %q", part)
+		}
+	}
+	return nil
+}
+
+// defaultExpr 把标签里的默认值转换成 Go 表达式
+func defaultExpr(typ, value string) (string, bool, error) {
+	switch typ {
+	case "string":
+		return strconv.Quote(value), false, nil
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "", false, err
+		}
+		return value, false, nil
+	case "time.Duration":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return "", false, err
+		}
+		return durationExpr(d), true, nil
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+		if _, err := strconv.ParseInt(value, 0, 64); err != nil {
+			return "", false, err
+		}
+		return value, false, nil
+	case "float32", "float64":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", false, err
+		}
+		return value, false, nil
+	}
+	return "", false, fmt.Errorf("default values are not supported for type %s", typ)
+}
+
+// durationExpr 用能整除的最大单位来写 Duration，比如 30 * time.Second
+func durationExpr(d time.Duration) string {
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"time.Hour", time.Hour},
+		{"time.Minute", time.Minute},
+		{"time.Second", time.Second},
+		{"time.Millisecond", time.Millisecond},
+		{"time.Microsecond", time.Microsecond},
+	}
+	for _, u := range units {
+		if d != 0 && d%u.d == 0 {
+			return fmt.Sprintf("%d * %s", d/u.d, u.name)
+		}
+	}
+	return fmt.Sprintf("%d * time.Nanosecond", d)
+}
+
+// zeroCheck 返回判断字段是不是零值的表达式模板
+func zeroCheck(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return `%s == ""`
+		case "bool":
+			return `!%s`
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+			"float32", "float64", "byte", "rune":
+			return `%s == 0`
+		}
+	case *ast.SelectorExpr:
+		if exprString(t) == "time.Duration" {
+			return `%s == 0`
+		}
+	case *ast.StarExpr, *ast.ArrayType, *ast.MapType, *ast.FuncType, *ast.ChanType, *ast.InterfaceType:
+		if at, ok := t.(*ast.ArrayType); ok && at.Len != nil {
+			break
+		}
+		return `%s == nil`
+	}
+	return `reflect.ValueOf(%s).IsZero()`
+}
+
+func exprString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+// packagesOf 返回类型表达式里引用到的包名
+func packagesOf(expr ast.Expr) []string {
+	var pkgs []string
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				pkgs = append(pkgs, id.Name)
+			}
+		}
+		return true
+	})
+	return pkgs
+}
+
+func render(pkg, typeName string, fields []field, imports map[string]string, optionsPkg string) ([]byte, error) {
+	need := map[string]bool{}
+	usesReflect := false
+	var required []field
+	for _, fd := range fields {
+		for _, p := range fd.Packages {
+			need[p] = true
+		}
+		if fd.NeedsTime {
+			need["time"] = true
+		}
+		if fd.Required {
+			required = append(required, fd)
+			if strings.HasPrefix(fd.Zero, "reflect.") {
+				usesReflect = true
+			}
+		}
+	}
+	var paths []string
+	for name := range need {
+		path, ok := imports[name]
+		if !ok && name == "time" {
+			path, ok = "time", true
+		}
+		if !ok {
+			return nil, fmt.Errorf("cannot find import for package %s", name)
+		}
+		if filepath.Base(path) != name {
+			path = name + " " + strconv.Quote(path)
+		} else {
+			path = strconv.Quote(path)
+		}
+		paths = append(paths, path)
+	}
+	if len(required) > 0 {
+		paths = append(paths, strconv.Quote("fmt"), strconv.Quote("strings"))
+	}
+	if usesReflect {
+		paths = append(paths, strconv.Quote("reflect"))
+	}
+	sort.Strings(paths)
+	// options 包不是标准库，和标准库的 import 之间空一行
+	paths = append(paths, "", strconv.Quote(optionsPkg))
+
+	opt := typeName + "Option"
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by optgen -type %s; DO NOT EDIT.\n\n", typeName)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	if len(paths) > 0 {
+		fmt.Fprintf(&b, "import (\n%s\n)\n\n", strings.Join(paths, "\n"))
+	}
+	fmt.Fprintf(&b, "type %s = options.Option[%s]\n\n", opt, typeName)
+	for _, fd := range fields {
+		fmt.Fprintf(&b, "func With%s(v %s) %s {\n\treturn options.Set(%q, func(x *%s) {\n\t\tx.%s = v\n\t})\n}\n\n",
+			fd.Name, fd.Type, opt, "With"+fd.Name, typeName, fd.Name)
+	}
+
+	// 默认值在 options.Apply 的 defaults 里设置，必填的检查在所有 opts 之后，所以有默认值的必填字段只有被 opts 改成零值才会报错
+	fmt.Fprintf(&b, "func New%s(opts ...%s) (*%s, error) {\n", typeName, opt, typeName)
+	fmt.Fprintf(&b, "\tx := &%s{}\n", typeName)
+	defaults := "nil"
+	var sets bytes.Buffer
+	for _, fd := range fields {
+		if fd.Default != "" {
+			fmt.Fprintf(&sets, "\t\tx.%s = %s\n", fd.Name, fd.Default)
+		}
+	}
+	if sets.Len() > 0 {
+		defaults = fmt.Sprintf("func(x *%s) {\n%s\t}", typeName, sets.String())
+	}
+	fmt.Fprintf(&b, "\tif err := options.Apply(x, %s, opts...); err != nil {\n\t\treturn nil, err\n\t}\n", defaults)
+	if len(required) > 0 {
+		fmt.Fprintf(&b, "\tvar missing []string\n")
+		for _, fd := range required {
+			fmt.Fprintf(&b, "\tif %s {\n\t\tmissing = append(missing, %q)\n\t}\n", fmt.Sprintf(fd.Zero, "x."+fd.Name), fd.Name)
+		}
+		fmt.Fprintf(&b, "\tif len(missing) > 0 {\n\t\treturn nil, fmt.Errorf(\"%s: missing required field(s): %%s\", strings.Join(missing, \", \"))\n\t}\n", typeName)
+	}
+	fmt.Fprintf(&b, "\treturn x, nil\n}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %w\n%s", err, b.Bytes())
+	}
+	return src, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTagDefaultAndRequired(t *testing.T) {
+	fd := field{Name: "Protocol", Type: "string"}
+	if err := fd.parseTag("default=tcp,required"); err != nil {
+		t.Fatal(err)
+	}
+	if fd.Default != `"tcp"` || !fd.Required {
+		t.Fatalf("got %+v", fd)
+	}
+}
+
+// TestExampleUpToDate 检查 example 里生成的代码和现在的 optgen 生成的一样，改了 optgen 之后要重新 go generate
+func TestExampleUpToDate(t *testing.T) {
+	dir := "example"
+	want, err := generate(dir, "Server", "server_options.go", "geekbang/options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "server_options.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("example/server_options.go is stale, run go generate ./optgen/example")
+	}
+}
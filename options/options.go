@@ -0,0 +1,132 @@
+// Package options 是一个通用的 Functional Options 框架，任何结构体都可以用，不用再为每个类型手写一遍 Option。
+package options
+
+import (
+	"fmt"
+	"strings"
+)
+
+/**
+1. New() 创建一个有名字、可以失败的 Option，Set() 创建一个不会失败的 Option；
+2. Group() 把多个 Option 组合成一个，可以用来做预设（preset），Group 还可以再嵌套 Group；
+3. Exclusive(key) 把 Option 标记为互斥，同一次 Apply() 里如果有两个 Option 用了同一个 key，就直接报错，一个 Option 都不会执行；
+4. Apply() 先执行 defaults 设置默认值，再按顺序执行所有的 Option，某个 Option 出错不会中断，所有错误最后合并成一个 Errors 返回。
+*/
+
+type Option[T any] struct {
+	name      string
+	apply     func(*T) error
+	exclusive string
+	isGroup   bool
+	group     []Option[T]
+}
+
+func New[T any](name string, apply func(*T) error) Option[T] {
+	return Option[T]{name: name, apply: apply}
+}
+
+func Set[T any](name string, set func(*T)) Option[T] {
+	return New(name, func(t *T) error {
+		set(t)
+		return nil
+	})
+}
+
+func Group[T any](name string, opts ...Option[T]) Option[T] {
+	return Option[T]{name: name, isGroup: true, group: opts}
+}
+
+func (o Option[T]) Name() string {
+	return o.name
+}
+
+// Exclusive 返回一个带互斥 key 的副本，原来的 Option 不受影响
+func (o Option[T]) Exclusive(key string) Option[T] {
+	o.exclusive = key
+	return o
+}
+
+// Errors 是 Apply() 收集到的所有错误
+type Errors []error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type ExclusiveError struct {
+	Key     string
+	Options []string
+}
+
+func (e *ExclusiveError) Error() string {
+	return fmt.Sprintf("options %s are mutually exclusive (%s)", strings.Join(e.Options, ", "), e.Key)
+}
+
+func Apply[T any](target *T, defaults func(*T), opts ...Option[T]) error {
+	if errs := checkExclusive(opts); len(errs) > 0 {
+		return errs
+	}
+	if defaults != nil {
+		defaults(target)
+	}
+	var errs Errors
+	for _, o := range opts {
+		errs = append(errs, o.applyTo(target)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (o Option[T]) applyTo(target *T) Errors {
+	if o.isGroup {
+		var errs Errors
+		for _, child := range o.group {
+			errs = append(errs, child.applyTo(target)...)
+		}
+		return errs
+	}
+	if o.apply == nil {
+		return nil
+	}
+	err := o.apply(target)
+	if err == nil {
+		return nil
+	}
+	if nested, ok := err.(Errors); ok {
+		return nested
+	}
+	return Errors{err}
+}
+
+// checkExclusive 展开所有的 Group，找出用了同一个互斥 key 的 Option
+func checkExclusive[T any](opts []Option[T]) Errors {
+	seen := map[string][]string{}
+	var keys []string
+	var walk func([]Option[T])
+	walk = func(opts []Option[T]) {
+		for _, o := range opts {
+			if o.exclusive != "" {
+				if _, ok := seen[o.exclusive]; !ok {
+					keys = append(keys, o.exclusive)
+				}
+				seen[o.exclusive] = append(seen[o.exclusive], o.name)
+			}
+			walk(o.group)
+		}
+	}
+	walk(opts)
+
+	var errs Errors
+	for _, key := range keys {
+		if names := seen[key]; len(names) > 1 {
+			errs = append(errs, &ExclusiveError{Key: key, Options: names})
+		}
+	}
+	return errs
+}
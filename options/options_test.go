@@ -0,0 +1,94 @@
+package options
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type config struct {
+	steps    []string
+	defaults bool
+}
+
+func step(name string) Option[config] {
+	return Set(name, func(c *config) { c.steps = append(c.steps, name) })
+}
+
+func fail(name string, err error) Option[config] {
+	return New(name, func(*config) error { return err })
+}
+
+func TestApplyCollectsAllErrors(t *testing.T) {
+	errA, errB, errC := errors.New("a"), errors.New("b"), errors.New("c")
+	var c config
+	err := Apply(&c, func(c *config) { c.defaults = true },
+		fail("A", errA),
+		step("one"),
+		// 返回 Errors 的 Option 会被展开，而不是嵌套成一个
+		fail("BC", Errors{errB, errC}),
+		step("two"),
+	)
+
+	var errs Errors
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, Errors{errA, errB, errC}) {
+		t.Fatalf("err = %#v, want Errors{a, b, c}", err)
+	}
+	if !c.defaults || !reflect.DeepEqual(c.steps, []string{"one", "two"}) {
+		t.Fatalf("config = %+v, want defaults and both steps applied despite the errors", c)
+	}
+	if got := err.Error(); got != "a; b; c" {
+		t.Fatalf("Error() = %q", got)
+	}
+	if err := Apply(&c, nil, step("three")); err != nil {
+		t.Fatalf("Apply without errors = %#v, want nil", err)
+	}
+}
+
+func TestNestedGroupsApplyInOrder(t *testing.T) {
+	errInner := errors.New("inner")
+	var c config
+	err := Apply(&c, nil,
+		step("first"),
+		Group("outer",
+			step("a"),
+			Group("inner", step("b"), fail("bad", errInner), step("c")),
+			step("d"),
+		),
+		step("last"),
+	)
+	if want := []string{"first", "a", "b", "c", "d", "last"}; !reflect.DeepEqual(c.steps, want) {
+		t.Fatalf("steps = %v, want %v", c.steps, want)
+	}
+	var errs Errors
+	if !errors.As(err, &errs) || !reflect.DeepEqual(errs, Errors{errInner}) {
+		t.Fatalf("err = %#v, want the error from the nested group", err)
+	}
+}
+
+func TestExclusiveThroughGroups(t *testing.T) {
+	preset := Group("preset", step("x"), step("cert-a").Exclusive("cert"))
+	var c config
+	err := Apply(&c, func(c *config) { c.defaults = true },
+		Group("outer", preset),
+		step("cert-b").Exclusive("cert"),
+		step("key-a").Exclusive("key"),
+	)
+
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("err = %v, want one ExclusiveError", err)
+	}
+	var ee *ExclusiveError
+	if !errors.As(errs[0], &ee) || ee.Key != "cert" || !reflect.DeepEqual(ee.Options, []string{"cert-a", "cert-b"}) {
+		t.Fatalf("err = %#v, want cert-a and cert-b reported for key cert", errs[0])
+	}
+	// 有冲突时 defaults 和所有的 Option 都不执行
+	if c.defaults || len(c.steps) != 0 {
+		t.Fatalf("config = %+v, want nothing applied", c)
+	}
+
+	if err := Apply(&c, nil, preset, step("key-a").Exclusive("key")); err != nil {
+		t.Fatalf("one option per key: %v", err)
+	}
+}